@@ -4,37 +4,64 @@ Package aememcache provides App Engine memcache cache that implements cache.Cach
 package aememcache
 
 import (
+	"bytes"
 	"context"
-	"strconv"
-	"strings"
 	"time"
 
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cacheitem"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cachekey"
+	"go.opencensus.io/trace"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
 	"google.golang.org/appengine/memcache"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 )
 
-// Cache is an implementation of cache.Cacher by App Engine memcache.
+// maxKeyLength is the maximum length of memcache keys.
+const maxKeyLength = 250
+
+// Cache is an implementation of cache.Cacher, cache.ErrorCacher and
+// cache.Locker by App Engine memcache.
 type Cache struct {
-	expiration time.Duration
+	expiration cache.Expiration
+	keys       *cachekey.Encoder
 }
 
-// NewCache returns a new Cache with given expiration. If set to 0, each item
-// has no expiration time.
-func NewCache(expiration time.Duration) *Cache {
+// NewCache returns a new Cache with given expiration. If set to the zero
+// value, each item has no expiration time. The keys are encoded by cachekey.Encoder with the
+// given options, and are hashed if they are longer than the limit of memcache.
+func NewCache(expiration cache.Expiration, opts ...cachekey.Option) *Cache {
 	return &Cache{
 		expiration: expiration,
+		keys:       cachekey.NewEncoder(append([]cachekey.Option{cachekey.WithMaxLength(maxKeyLength)}, opts...)...),
 	}
 }
 
 // GetMulti returns the values of the given keys as a slice of []byte. If the
 // item is not found, the corresponding index of the return value will be nil.
 func (c *Cache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/aememcache.GetMulti")
+	defer func() { span.End() }()
+
+	ret, _ := c.getMulti(ctx, keys)
+	return ret
+}
+
+// GetMultiWithError is the same as GetMulti except that it returns the error
+// of memcache.
+func (c *Cache) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/aememcache.GetMultiWithError")
+	defer func() { span.End() }()
+
+	return c.getMulti(ctx, keys)
+}
+
+func (c *Cache) getMulti(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
 	key := make([]string, len(keys))
 	keymap := make(map[string]int, len(keys))
 	for i, k := range keys {
-		ks := keystr(k)
+		ks := c.keys.Encode(k)
 		key[i] = ks
 		keymap[ks] = i
 	}
@@ -42,37 +69,59 @@ func (c *Cache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte
 	items, err := memcache.GetMulti(ctx, key)
 	if err != nil {
 		log.Debugf(ctx, "memcache.GetMulti() err = %v", err)
-		return nil
+		return nil, err
 	}
 
 	ret := make([][]byte, len(keys))
 	for k, v := range items {
-		ret[keymap[k]] = v.Value
+		// A lease is missing.
+		ret[keymap[k]] = cacheitem.Value(v.Value)
 	}
-	return ret
+	return ret, nil
 }
 
 // SetMulti sets the given keys and values to items.
 func (c *Cache) SetMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/aememcache.SetMulti")
+	defer func() { span.End() }()
+
+	c.setMulti(ctx, keys, values)
+}
+
+// SetMultiWithError is the same as SetMulti except that it returns the error
+// of memcache.
+func (c *Cache) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/aememcache.SetMultiWithError")
+	defer func() { span.End() }()
+
+	return c.setMulti(ctx, keys, values)
+}
+
+func (c *Cache) setMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
 	items := make([]*memcache.Item, len(keys))
 	for i, k := range keys {
 		items[i] = &memcache.Item{
-			Key:        keystr(k),
+			Key:        c.keys.Encode(k),
 			Value:      values[i],
-			Expiration: c.expiration,
+			Expiration: c.expiration.Next(),
 		}
 	}
 	if err := memcache.SetMulti(ctx, items); err != nil {
 		log.Debugf(ctx, "memcache.SetMulti() err = %v", err)
+		return err
 	}
+	return nil
 }
 
 // DeleteMulti deletes items for the given keys. It returns an error if the
 // target exists and could not be deleted.
 func (c *Cache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/aememcache.DeleteMulti")
+	defer func() { span.End() }()
+
 	key := make([]string, len(keys))
 	for i, k := range keys {
-		key[i] = keystr(k)
+		key[i] = c.keys.Encode(k)
 	}
 
 	err := memcache.DeleteMulti(ctx, key)
@@ -93,23 +142,155 @@ func (c *Cache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error
 	return nil
 }
 
-func keystr(key *datastorepb.Key) string {
-	var b strings.Builder
-
-	if ns := key.GetPartitionId().GetNamespaceId(); ns != "" {
-		b.WriteString(ns)
-	} else {
-		b.WriteString("[default]")
-	}
-	for _, p := range key.GetPath() {
-		b.WriteString(p.GetKind())
-		switch p.GetIdType().(type) {
-		case *datastorepb.Key_PathElement_Id:
-			b.WriteString(strconv.FormatInt(p.GetId(), 10))
-		case *datastorepb.Key_PathElement_Name:
-			b.WriteString(strconv.Quote(p.GetName()))
+// LeaseMulti acquires leases for the given keys that have neither an item nor
+// a lease.
+func (c *Cache) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/aememcache.LeaseMulti")
+	defer func() { span.End() }()
+
+	leases := make([]uint64, len(keys))
+	items := make([]*memcache.Item, len(keys))
+	for i, k := range keys {
+		l, err := cacheitem.NewLease()
+		if err != nil {
+			return nil, err
+		}
+		leases[i] = l
+		items[i] = &memcache.Item{
+			Key:        c.keys.Encode(k),
+			Value:      cacheitem.Lease(l),
+			Expiration: cacheitem.LeaseExpiration,
+		}
+	}
+
+	err := memcache.AddMulti(ctx, items)
+	if err == nil {
+		return leases, nil
+	}
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		log.Debugf(ctx, "memcache.AddMulti() err = %v", err)
+		return nil, err
+	}
+	for i, e := range merr {
+		if e != nil {
+			// The item or another lease exists.
+			leases[i] = 0
 		}
 	}
+	return leases, nil
+}
+
+// SetItems sets the given items. An item with a lease is set only if the lease
+// is held, and an item without a lease is not set if the key has a lease or a
+// lock, or the item has a newer version. An item with Replace is set only if
+// the key has an item.
+func (c *Cache) SetItems(ctx context.Context, items []*cache.Item) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/aememcache.SetItems")
+	defer func() { span.End() }()
 
-	return b.String()
+	if len(items) == 0 {
+		return nil
+	}
+	keys := make([]string, len(items))
+	for i, v := range items {
+		keys[i] = c.keys.Encode(v.Key)
+	}
+	got, err := memcache.GetMulti(ctx, keys)
+	if err != nil {
+		log.Debugf(ctx, "memcache.GetMulti() err = %v", err)
+		return err
+	}
+
+	var add, cas []*memcache.Item
+	for i, v := range items {
+		ks := keys[i]
+		value := v.Value
+		if v.Version != 0 {
+			value = cacheitem.Versioned(v.Version, v.Value)
+		}
+
+		cur, ok := got[ks]
+		switch {
+		case v.Lease != 0:
+			if !ok || !bytes.Equal(cur.Value, cacheitem.Lease(v.Lease)) {
+				continue
+			}
+		case !ok && v.Replace:
+			continue
+		case !ok:
+			add = append(add, &memcache.Item{Key: ks, Value: value, Expiration: c.itemExpiration(v)})
+			continue
+		case cacheitem.IsLease(cur.Value):
+			// Leased or locked by others.
+			continue
+		case v.Version != 0 && cacheitem.Version(cur.Value) > v.Version:
+			continue
+		}
+		cur.Value = value
+		cur.Expiration = c.itemExpiration(v)
+		cas = append(cas, cur)
+	}
+
+	if len(add) > 0 {
+		if err := ignoreConflicts(memcache.AddMulti(ctx, add)); err != nil {
+			log.Debugf(ctx, "memcache.AddMulti() err = %v", err)
+			return err
+		}
+	}
+	if len(cas) > 0 {
+		if err := ignoreConflicts(memcache.CompareAndSwapMulti(ctx, cas)); err != nil {
+			log.Debugf(ctx, "memcache.CompareAndSwapMulti() err = %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// itemExpiration returns the expiration of the item, or the expiration of the
+// Cache if the item does not have it.
+func (c *Cache) itemExpiration(item *cache.Item) time.Duration {
+	if item.Expiration != 0 {
+		return item.Expiration
+	}
+	return c.expiration.Next()
+}
+
+// ignoreConflicts returns nil if all errors are caused by concurrent updates.
+func ignoreConflicts(err error) error {
+	merr, ok := err.(appengine.MultiError)
+	if !ok {
+		return err
+	}
+	for _, e := range merr {
+		if e != nil && e != memcache.ErrCASConflict && e != memcache.ErrNotStored {
+			return merr
+		}
+	}
+	return nil
+}
+
+// LockMulti locks the given keys until the expiration.
+func (c *Cache) LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/aememcache.LockMulti")
+	defer func() { span.End() }()
+
+	items := make([]*memcache.Item, len(keys))
+	for i, k := range keys {
+		// A lock is a lease that is never held by anyone.
+		l, err := cacheitem.NewLease()
+		if err != nil {
+			return err
+		}
+		items[i] = &memcache.Item{
+			Key:        c.keys.Encode(k),
+			Value:      cacheitem.Lease(l),
+			Expiration: expiration,
+		}
+	}
+	if err := memcache.SetMulti(ctx, items); err != nil {
+		log.Debugf(ctx, "memcache.SetMulti() err = %v", err)
+		return err
+	}
+	return nil
 }
@@ -8,6 +8,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cacheitem"
 	"google.golang.org/appengine/aetest"
 	"google.golang.org/appengine/memcache"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
@@ -47,7 +49,7 @@ func TestCache_GetMulti(t *testing.T) {
 			fields: fields{
 				expiration: 1 * time.Hour,
 				items: []*memcache.Item{
-					{Key: "[default]k1", Value: []byte{'a'}},
+					{Key: "v1///k/i1", Value: []byte{'a'}},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -62,8 +64,8 @@ func TestCache_GetMulti(t *testing.T) {
 			fields: fields{
 				expiration: 1 * time.Hour,
 				items: []*memcache.Item{
-					{Key: "[default]k1", Value: []byte{'a'}},
-					{Key: "[default]k2", Value: []byte{'b'}},
+					{Key: "v1///k/i1", Value: []byte{'a'}},
+					{Key: "v1///k/i2", Value: []byte{'b'}},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -94,8 +96,8 @@ func TestCache_GetMulti(t *testing.T) {
 			fields: fields{
 				expiration: 1,
 				items: []*memcache.Item{
-					{Key: "[default]k1", Value: []byte{'a'}, Expiration: 1},
-					{Key: "[default]k2", Value: []byte{'b'}, Expiration: 1},
+					{Key: "v1///k/i1", Value: []byte{'a'}, Expiration: 1},
+					{Key: "v1///k/i2", Value: []byte{'b'}, Expiration: 1},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -112,7 +114,7 @@ func TestCache_GetMulti(t *testing.T) {
 			name: "1 found 1 not found",
 			fields: fields{
 				items: []*memcache.Item{
-					{Key: "[default]k2", Value: []byte{'b'}},
+					{Key: "v1///k/i2", Value: []byte{'b'}},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -134,7 +136,7 @@ func TestCache_GetMulti(t *testing.T) {
 					t.Fatal(err)
 				}
 			}
-			c := NewCache(tt.fields.expiration)
+			c := NewCache(cache.TTL(tt.fields.expiration))
 			if got := c.GetMulti(ctx, tt.args.keys); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Cache.GetMulti() = %v, want %v", got, tt.want)
 			}
@@ -180,7 +182,7 @@ func TestCache_SetMulti(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			defer memcache.Flush(ctx)
-			c := NewCache(0)
+			c := NewCache(cache.Expiration{})
 			c.SetMulti(ctx, tt.args.keys, tt.args.values)
 			stats, err := memcache.Stats(ctx)
 			if err != nil {
@@ -210,8 +212,8 @@ func TestCache_DeleteMulti(t *testing.T) {
 		{
 			name: "1 item",
 			fields: fields{items: []*memcache.Item{
-				{Key: "[default]k1", Value: []byte{'a'}},
-				{Key: "[default]k2", Value: []byte{'b'}},
+				{Key: "v1///k/i1", Value: []byte{'a'}},
+				{Key: "v1///k/i2", Value: []byte{'b'}},
 			}},
 			args: args{keys: []*datastorepb.Key{
 				{
@@ -223,8 +225,8 @@ func TestCache_DeleteMulti(t *testing.T) {
 		{
 			name: "2 items",
 			fields: fields{items: []*memcache.Item{
-				{Key: "[default]k1", Value: []byte{'a'}},
-				{Key: "[default]k2", Value: []byte{'b'}},
+				{Key: "v1///k/i1", Value: []byte{'a'}},
+				{Key: "v1///k/i2", Value: []byte{'b'}},
 			}},
 			args: args{keys: []*datastorepb.Key{
 				{
@@ -239,7 +241,7 @@ func TestCache_DeleteMulti(t *testing.T) {
 		{
 			name: "not found",
 			fields: fields{items: []*memcache.Item{
-				{Key: "[default]k2", Value: []byte{'b'}},
+				{Key: "v1///k/i2", Value: []byte{'b'}},
 			}},
 			args: args{keys: []*datastorepb.Key{
 				{
@@ -257,7 +259,7 @@ func TestCache_DeleteMulti(t *testing.T) {
 					t.Fatal(err)
 				}
 			}
-			c := NewCache(0)
+			c := NewCache(cache.Expiration{})
 			if err := c.DeleteMulti(ctx, tt.args.keys); (err != nil) != tt.wantErr {
 				t.Errorf("Cache.DeleteMulti() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -271,3 +273,315 @@ func TestCache_DeleteMulti(t *testing.T) {
 		})
 	}
 }
+
+func TestCache_LeaseMulti(t *testing.T) {
+	type fields struct {
+		items []*memcache.Item
+	}
+	type args struct {
+		keys []*datastorepb.Key
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   []bool
+	}{
+		{
+			name: "not found",
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+				},
+			}},
+			want: []bool{true, true},
+		},
+		{
+			name: "1 found 1 not found",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: []byte{'a'}},
+			}},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+				},
+			}},
+			want: []bool{false, true},
+		},
+		{
+			name: "leased",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: cacheitem.Lease(1)},
+			}},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+			}},
+			want: []bool{false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer memcache.Flush(ctx)
+			if len(tt.fields.items) > 0 {
+				if err := memcache.SetMulti(ctx, tt.fields.items); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := NewCache(cache.Expiration{})
+			leases, err := c.LeaseMulti(ctx, tt.args.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]bool, len(leases))
+			for i, l := range leases {
+				got[i] = l != 0
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cache.LeaseMulti() = %v, want acquired %v", leases, tt.want)
+			}
+			for i, v := range c.GetMulti(ctx, tt.args.keys) {
+				if tt.want[i] && v != nil {
+					t.Errorf("Cache.GetMulti() = %v, want leased key to be missing", v)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_SetItems(t *testing.T) {
+	type fields struct {
+		items []*memcache.Item
+	}
+	type args struct {
+		items []*cache.Item
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   [][]byte
+	}{
+		{
+			name: "without lease",
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+				},
+			}},
+			want: [][]byte{{'a'}},
+		},
+		{
+			name: "lease held",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: cacheitem.Lease(1)},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+					Lease: 1,
+				},
+			}},
+			want: [][]byte{{'a'}},
+		},
+		{
+			name: "lease released",
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+					Lease: 1,
+				},
+			}},
+			want: [][]byte{nil},
+		},
+		{
+			name: "lease taken over",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: cacheitem.Lease(2)},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+					Lease: 1,
+				},
+			}},
+			want: [][]byte{nil},
+		},
+		{
+			name: "leased by others",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: cacheitem.Lease(2)},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+				},
+			}},
+			want: [][]byte{nil},
+		},
+		{
+			name: "newer version",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: cacheitem.Versioned(1, []byte{'a'})},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'b'},
+					Version: 2,
+				},
+			}},
+			want: [][]byte{{'b'}},
+		},
+		{
+			name: "older version",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: cacheitem.Versioned(2, []byte{'a'})},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'b'},
+					Version: 1,
+				},
+			}},
+			want: [][]byte{{'a'}},
+		},
+		{
+			name: "without version",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: cacheitem.Versioned(2, []byte{'a'})},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'b'},
+				},
+			}},
+			want: [][]byte{{'b'}},
+		},
+		{
+			name: "replace",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: []byte{'a'}},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'b'},
+					Replace: true,
+				},
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+					},
+					Value:   []byte{'c'},
+					Replace: true,
+				},
+			}},
+			want: [][]byte{{'b'}, nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer memcache.Flush(ctx)
+			if len(tt.fields.items) > 0 {
+				if err := memcache.SetMulti(ctx, tt.fields.items); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c := NewCache(cache.Expiration{})
+			if err := c.SetItems(ctx, tt.args.items); err != nil {
+				t.Fatal(err)
+			}
+			keys := make([]*datastorepb.Key, len(tt.args.items))
+			for i, v := range tt.args.items {
+				keys[i] = v.Key
+			}
+			if got := c.GetMulti(ctx, keys); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cache.GetMulti() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCache_LockMulti(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+		},
+	}
+
+	defer memcache.Flush(ctx)
+	if err := memcache.Set(ctx, &memcache.Item{Key: "v1///k/i1", Value: []byte{'a'}}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCache(cache.Expiration{})
+	leases, err := c.LeaseMulti(ctx, keys[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LockMulti(ctx, keys, 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.GetMulti(ctx, keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want locked keys to be missing", got)
+	}
+	if got, _ := c.LeaseMulti(ctx, keys); !reflect.DeepEqual(got, []uint64{0, 0}) {
+		t.Errorf("Cache.LeaseMulti() = %v, want no leases for locked keys", got)
+	}
+	if err := c.SetItems(ctx, []*cache.Item{{Key: keys[1], Value: []byte{'b'}, Lease: leases[0]}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(ctx, keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want a lease acquired before locking to be released", got)
+	}
+	if err := c.SetItems(ctx, []*cache.Item{{Key: keys[0], Value: []byte{'c'}, Version: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(ctx, keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want an item without a lease not to overwrite the lock", got)
+	}
+
+	if err := c.DeleteMulti(ctx, keys); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.LeaseMulti(ctx, keys); got[0] == 0 || got[1] == 0 {
+		t.Errorf("Cache.LeaseMulti() = %v, want leases for unlocked keys", got)
+	}
+}
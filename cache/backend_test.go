@@ -0,0 +1,253 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/memory"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+)
+
+var backendKey = &datastorepb.Key{
+	Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Name{Name: "1"}}},
+}
+
+// backendInvoker returns an invoker that finds all entities, and calls during
+// while looking up.
+func backendInvoker(during func(ctx context.Context)) grpc.UnaryInvoker {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		switch out := reply.(type) {
+		case *datastorepb.CommitResponse:
+			out.MutationResults = []*datastorepb.MutationResult{{Version: 2}}
+		case *datastorepb.LookupResponse:
+			if during != nil {
+				during(ctx)
+			}
+			for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+				out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}, Version: 1})
+			}
+		}
+		return nil
+	}
+}
+
+func TestRefreshWithLeaser(t *testing.T) {
+	old := []byte("old")
+	tests := []struct {
+		name   string
+		cached bool
+		locked bool
+		commit bool
+		want   bool
+	}{
+		{
+			name: "uncached",
+			want: true,
+		},
+		{
+			name:   "cached",
+			cached: true,
+			want:   true,
+		},
+		{
+			name:   "locked",
+			cached: true,
+			locked: true,
+		},
+		{
+			name:   "committed while refreshing",
+			cached: true,
+			commit: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			c := memory.NewCache(cache.Expiration{})
+			if tt.cached {
+				c.SetMulti(ctx, []*datastorepb.Key{backendKey}, [][]byte{old})
+			}
+			if tt.locked {
+				if err := c.LockMulti(ctx, []*datastorepb.Key{backendKey}, 1*time.Hour); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			interceptor := cache.UnaryClientInterceptor(c)
+			var during func(ctx context.Context)
+			if tt.commit {
+				during = func(ctx context.Context) {
+					commit := &datastorepb.CommitRequest{Mutations: []*datastorepb.Mutation{
+						{Operation: &datastorepb.Mutation_Delete{Delete: backendKey}},
+					}}
+					if err := interceptor(ctx, "/google.datastore.v1.Datastore/Commit", commit, &datastorepb.CommitResponse{}, nil, backendInvoker(nil)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			req := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{backendKey}}
+			if err := interceptor(cache.Refresh(ctx), "/google.datastore.v1.Datastore/Lookup", req, &datastorepb.LookupResponse{}, nil, backendInvoker(during)); err != nil {
+				t.Fatal(err)
+			}
+
+			got := c.GetMulti(ctx, []*datastorepb.Key{backendKey})[0]
+			if refreshed := got != nil && !bytes.Equal(got, old); refreshed != tt.want {
+				t.Errorf("refreshed = %v, want %v", refreshed, tt.want)
+			}
+		})
+	}
+}
+
+// notifyingCache is a memory.Cache that notifies when SetItems returns.
+type notifyingCache struct {
+	*memory.Cache
+	set chan struct{}
+}
+
+func (c *notifyingCache) SetItems(ctx context.Context, items []*cache.Item) error {
+	defer func() { c.set <- struct{}{} }()
+	return c.Cache.SetItems(ctx, items)
+}
+
+func TestStaleWhileRevalidateWithLeaser(t *testing.T) {
+	ctx := context.Background()
+	c := &notifyingCache{Cache: memory.NewCache(cache.Expiration{}), set: make(chan struct{}, 1)}
+	interceptor := cache.UnaryClientInterceptor(c, cache.WithStaleWhileRevalidate(1*time.Millisecond, 1*time.Hour))
+	lookup := func(invoker grpc.UnaryInvoker) {
+		req := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{backendKey}}
+		if err := interceptor(ctx, "/google.datastore.v1.Datastore/Lookup", req, &datastorepb.LookupResponse{}, nil, invoker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup(backendInvoker(nil))
+	<-c.set
+	time.Sleep(2 * time.Millisecond)
+
+	// The entity deleted by a Commit during the refresh is not saved again.
+	lookup(backendInvoker(func(ctx context.Context) {
+		commit := &datastorepb.CommitRequest{Mutations: []*datastorepb.Mutation{
+			{Operation: &datastorepb.Mutation_Delete{Delete: backendKey}},
+		}}
+		if err := interceptor(ctx, "/google.datastore.v1.Datastore/Commit", commit, &datastorepb.CommitResponse{}, nil, backendInvoker(nil)); err != nil {
+			t.Error(err)
+		}
+	}))
+	select {
+	case <-c.set:
+	case <-time.After(1 * time.Second):
+		t.Fatal("not refreshed")
+	}
+	if got := c.GetMulti(ctx, []*datastorepb.Key{backendKey})[0]; got != nil {
+		t.Errorf("Cache.GetMulti() = %q, want nil", got)
+	}
+}
+
+type backendValueKey struct{}
+
+func TestStaleWhileRevalidateAfterCancel(t *testing.T) {
+	c := &notifyingCache{Cache: memory.NewCache(cache.Expiration{}), set: make(chan struct{}, 1)}
+	interceptor := cache.UnaryClientInterceptor(c, cache.WithStaleWhileRevalidate(1*time.Millisecond, 1*time.Hour))
+	lookup := func(ctx context.Context, invoker grpc.UnaryInvoker) {
+		req := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{backendKey}}
+		if err := interceptor(ctx, "/google.datastore.v1.Datastore/Lookup", req, &datastorepb.LookupResponse{}, nil, invoker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lookup(context.Background(), backendInvoker(nil))
+	<-c.set
+	time.Sleep(2 * time.Millisecond)
+
+	// The refresh has the values of the call, and is not canceled with it.
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), backendValueKey{}, "v"))
+	canceled := make(chan struct{})
+	lookup(ctx, backendInvoker(func(ctx context.Context) {
+		<-canceled
+		if err := ctx.Err(); err != nil {
+			t.Errorf("ctx.Err() = %v, want nil", err)
+		}
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("ctx.Deadline() = _, false, want true")
+		}
+		if got := ctx.Value(backendValueKey{}); got != "v" {
+			t.Errorf("ctx.Value() = %v, want v", got)
+		}
+	}))
+	cancel()
+	close(canceled)
+	select {
+	case <-c.set:
+	case <-time.After(1 * time.Second):
+		t.Fatal("not refreshed")
+	}
+}
+
+func TestSingleflightAfterCommit(t *testing.T) {
+	ctx := context.Background()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var version int64 = 1
+	lookups := 0
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		mu.Lock()
+		defer mu.Unlock()
+		switch out := reply.(type) {
+		case *datastorepb.CommitResponse:
+			version = 2
+			out.MutationResults = []*datastorepb.MutationResult{{Version: version}}
+		case *datastorepb.LookupResponse:
+			out.Found = []*datastorepb.EntityResult{{Entity: &datastorepb.Entity{Key: backendKey}, Version: version}}
+			lookups++
+			if lookups == 1 {
+				// Block the first lookup until the end of the test.
+				close(started)
+				mu.Unlock()
+				<-release
+				mu.Lock()
+			}
+		}
+		return nil
+	}
+	interceptor := cache.UnaryClientInterceptor(memory.NewCache(cache.Expiration{}), cache.WithSingleflight())
+	lookup := func() <-chan int64 {
+		ret := make(chan int64, 1)
+		go func() {
+			req := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{backendKey}}
+			out := &datastorepb.LookupResponse{}
+			if err := interceptor(ctx, "/google.datastore.v1.Datastore/Lookup", req, out, nil, invoker); err != nil {
+				t.Error(err)
+			}
+			ret <- out.GetFound()[0].GetVersion()
+		}()
+		return ret
+	}
+
+	before := lookup()
+	<-started
+	commit := &datastorepb.CommitRequest{Mutations: []*datastorepb.Mutation{
+		{Operation: &datastorepb.Mutation_Upsert{Upsert: &datastorepb.Entity{Key: backendKey}}},
+	}}
+	if err := interceptor(ctx, "/google.datastore.v1.Datastore/Commit", commit, &datastorepb.CommitResponse{}, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+
+	// The lookup after the commit does not join the lookup before it.
+	after := lookup()
+	select {
+	case v := <-after:
+		if v != 2 {
+			t.Errorf("version = %v, want 2", v)
+		}
+	case <-time.After(1 * time.Second):
+		t.Error("the lookup after the commit waits for the lookup before it")
+	}
+	close(release)
+	if v := <-before; v != 1 {
+		t.Errorf("version = %v, want 1", v)
+	}
+}
@@ -7,11 +7,21 @@ cache.
 	- Get
 	- GetMulti
 
-Cached data is deleted when data is updated or deleted, including
+Cached data is deleted when data is inserted, updated or deleted, including
 transaction.
 	- Put/PutMulti(when key is not IncompleteKey)
 	- Delete/DeleteMulti
-	- Mutation(Update, Upsert, Delete)
+	- Mutation(Insert, Update, Upsert, Delete)
+
+By default, only entities found in the datastore are cached. With
+WithNegativeCache, missing entities are also cached as tombstones, and Get
+returns ErrNoSuchEntity for them without calling the datastore until they are
+inserted.
+
+If the Cacher implements Leaser, a lease is acquired for each key missing in
+the cache before retrieving it from the datastore, and the retrieved data is
+saved only while the lease is held. This prevents saving stale data when the
+cache is deleted by a commit during the retrieval.
 
 Even if changes are applied to the datastore, the cache deletion may fail.
 In that case, the data will be inconsistent until the datastore is rolled
@@ -19,6 +29,38 @@ back or the cache is deleted.
 
 Note that RunInTransaction does not roll back when cache deletion fails.
 
+With WithCommitLock, the keys are locked in the cache before the commit. If
+the cache deletion fails after the commit, the keys are not cached until the
+locks expire, and the commit does not fail.
+
+With WithWriteThrough, the written entities are saved after the commit, so
+that the next retrieval of them uses the cache.
+
+With WithSingleflight, concurrent retrievals of the same keys missing in the
+cache share one Lookup call of each key.
+
+With WithStaleWhileRevalidate, cached entities have a soft expiration. After
+it, they are still used while they are refreshed in the background, and
+WithEarlyRefresh refreshes hot entities probabilistically before it.
+
+With WithMaxValueSize, entities too large for the Cacher are not saved.
+Wrap the Cacher by chunk.NewCache to save them as multiple items instead.
+
+The cache can be controlled for each call by the context returned by Bypass,
+Refresh, ReadOnly and SkipInvalidation.
+
+With WithPolicy, whether to cache and the expiration are decided for each
+kind and namespace.
+
+Errors of the Cacher are not returned except for the cache deletion and
+locking of commits. With WithErrorHandler, they can be logged or counted.
+
+The interceptor records OpenCensus measures of cache hits, misses, fills and
+invalidations. Register DefaultViews to export them.
+
+Cached data is saved with the version of the entity. If the Cacher
+implements ItemSetter, the cached data is not overwritten by older one.
+
 The advantage of using an interceptor is that can be used without changing
 the client of cloud.google.com/go/datastore. However, unlike packages that
 wrap the client like github.com/mjibson/goon, it's not possible to provide
@@ -29,13 +71,22 @@ package cache
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/golang/protobuf/proto"
+	"go.opencensus.io/trace"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 	"google.golang.org/grpc"
 )
 
 // Cacher is the interface implemented by an object that manages the cache.
+//
+// The keys passed to the Cacher have the project ID of the request in their
+// partition IDs, so the Cacher should distinguish keys by the project ID as
+// well as the namespace and the path.
 type Cacher interface {
 	// GetMulti returns the values of the given keys as a slice of []byte.
 	// The length of this slice must be the same as length of the keys.
@@ -54,95 +105,699 @@ type Cacher interface {
 	DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error
 }
 
+// ErrorCacher is the interface implemented by an object that manages the
+// cache and reports the errors of the backend. If the Cacher implements it,
+// GetMultiWithError and SetMultiWithError are used instead of GetMulti and
+// SetMulti, and the errors are passed to the ErrorHandler set by
+// WithErrorHandler.
+type ErrorCacher interface {
+	// GetMultiWithError is the same as Cacher.GetMulti except that it returns
+	// the error of the backend. The values are treated as missing if the
+	// error is not nil.
+	GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error)
+
+	// SetMultiWithError is the same as Cacher.SetMulti except that it returns
+	// the error of the backend.
+	SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error
+
+	// DeleteMulti is the same as Cacher.DeleteMulti.
+	DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error
+}
+
+// AdaptCacher returns the Cacher as an ErrorCacher. If the Cacher does not
+// implement ErrorCacher, GetMultiWithError and SetMultiWithError of the
+// returned ErrorCacher always return nil errors.
+func AdaptCacher(cacher Cacher) ErrorCacher {
+	if c, ok := cacher.(ErrorCacher); ok {
+		return c
+	}
+	return cacherAdapter{cacher}
+}
+
+type cacherAdapter struct {
+	Cacher
+}
+
+func (a cacherAdapter) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	return a.GetMulti(ctx, keys), nil
+}
+
+func (a cacherAdapter) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	a.SetMulti(ctx, keys, values)
+	return nil
+}
+
+// Item is an item saved by ItemSetter.
+type Item struct {
+	Key   *datastorepb.Key
+	Value []byte
+
+	// Lease is the lease for Key acquired by Leaser.LeaseMulti. If it is not
+	// 0, the item is saved only while the lease is held.
+	Lease uint64
+
+	// Version is the version of the entity in Value. If it is not 0, the
+	// item is not saved when the cached item has a newer version. If it is
+	// 0, the item is saved regardless of the version of the cached item.
+	Version int64
+
+	// Expiration is the expiration of the item decided by Policy. If it is
+	// 0, the default expiration of the Cacher is used.
+	Expiration time.Duration
+
+	// Replace reports whether the item is saved only if an unexpired value is
+	// cached for Key, like the replace command of memcached. It is used to
+	// refresh the cached values that can't be leased.
+	Replace bool
+}
+
+// ItemSetter is an optional interface implemented by a Cacher that can save
+// items with attributes. If the Cacher implements it, SetItems is used
+// instead of SetMulti.
+type ItemSetter interface {
+	// SetItems saves the given items. An item with a lease must not be saved
+	// if the lease has expired or has been released. An item without a lease
+	// must not overwrite an unexpired lease or lock. An item with a version
+	// must not overwrite a cached item with a newer version, and an item
+	// without a version overwrites the cached item of any version. An item
+	// with Replace must not be saved if no value is cached.
+	SetItems(ctx context.Context, items []*Item) error
+}
+
+// Leaser is an optional interface implemented by a Cacher that supports
+// filling the cache with leases, like the lock items of
+// github.com/mjibson/goon.
+//
+// A lease is acquired when the value is missing in the cache, and is released
+// by DeleteMulti. Therefore, a value retrieved from the datastore before the
+// entity is updated is not saved if the cache is deleted while retrieving.
+type Leaser interface {
+	ItemSetter
+
+	// LeaseMulti acquires leases for the given keys. The length of the
+	// returned slice must be the same as length of the keys. If a lease is
+	// not acquired because the value or another lease exists, set
+	// corresponding elements to 0. Leases must expire in a short time.
+	LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error)
+}
+
+// Locker is an optional interface implemented by a Cacher that can lock keys
+// before commits.
+type Locker interface {
+	Leaser
+
+	// LockMulti locks the given keys until the expiration. A locked key is
+	// treated as missing by GetMulti, and a lease for it can't be acquired.
+	// Values and leases of the keys are discarded. A lock is released by
+	// DeleteMulti.
+	LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error
+}
+
+const defaultMaxLookupRounds = 100
+
+// refreshTimeout is the timeout of a refresh of stale entities, which
+// continues after the call returns. It is as long as the lease expiration.
+const refreshTimeout = 30 * time.Second
+
+type options struct {
+	negativeCache   bool
+	maxLookupRounds int
+	lockExpiration  time.Duration
+	writeThrough    bool
+	maxVersionLag   int64
+	policy          Policy
+	backendName     string
+	errorHandler    ErrorHandler
+	singleflight    bool
+	softExpiration  time.Duration
+	staleExpiration time.Duration
+	earlyRefresh    float64
+	maxValueSize    int
+}
+
+// Option configures the interceptor returned by UnaryClientInterceptor.
+type Option func(*options)
+
+// WithNegativeCache returns an Option that caches entities missing in the
+// datastore as tombstones. A tombstone is deleted when the entity is inserted,
+// updated or deleted as well as other cached data.
+func WithNegativeCache() Option {
+	return func(o *options) {
+		o.negativeCache = true
+	}
+}
+
+// WithMaxLookupRounds returns an Option that limits the number of Lookup
+// calls to the datastore for a single lookup. Keys that are still deferred by
+// the datastore after n calls are returned as deferred to the caller. The
+// default is 100, which is the same as cloud.google.com/go/datastore.
+func WithMaxLookupRounds(n int) Option {
+	return func(o *options) {
+		o.maxLookupRounds = n
+	}
+}
+
+// WithCommitLock returns an Option that locks the keys to be deleted from the
+// cache before calling Commit if the Cacher implements Locker. The locks
+// expire after the expiration, or are released after the commit.
+//
+// The keys are not cached while they are locked, so stale data is not used
+// even if the cache deletion fails after the commit. In this case, the
+// commit does not fail since the locks expire in a short time. If locking
+// fails, the commit is not called and the error is returned.
+func WithCommitLock(expiration time.Duration) Option {
+	return func(o *options) {
+		o.lockExpiration = expiration
+	}
+}
+
+// WithWriteThrough returns an Option that saves the inserted, updated and
+// upserted entities after the cache deletion of a successful commit. An entity
+// with an incomplete key is saved with the key allocated by the datastore.
+//
+// Note that if the same entity is committed concurrently, an older entity may
+// be saved.
+func WithWriteThrough() Option {
+	return func(o *options) {
+		o.writeThrough = true
+	}
+}
+
+// WithMaxVersionLag returns an Option that does not use the cached data when
+// its version lags behind the version committed by this process by more than
+// lag. Since the versions of up to 10000 recently committed keys are
+// recorded, it only detects the cached data that failed to be deleted or was
+// saved by a concurrent retrieval.
+func WithMaxVersionLag(lag int64) Option {
+	return func(o *options) {
+		o.maxVersionLag = lag
+	}
+}
+
+// Policy decides whether entities of the kind in the namespace are cached and
+// their expiration. If the expiration is 0, the default expiration of the
+// Cacher is used.
+type Policy func(namespace, kind string) (cache bool, expiration time.Duration)
+
+// WithPolicy returns an Option that caches entities according to the policy.
+// Entities that are not cached are always retrieved from the datastore, and
+// the commits of them do not delete the cache. The expiration is passed to
+// the Cacher by Item if it implements ItemSetter, and is ignored otherwise.
+// It is used as it is without the jitter of the Expiration of the Cacher, so
+// return e.g. cache.TTLJitter(time.Hour, 10).Next() to spread the expirations.
+//
+// For example, the following policy does not cache the kind "Counter" and
+// caches the kind "Config" for an hour.
+//
+//	cache.WithPolicy(func(namespace, kind string) (bool, time.Duration) {
+//		switch kind {
+//		case "Counter":
+//			return false, 0
+//		case "Config":
+//			return true, time.Hour
+//		}
+//		return true, 0
+//	})
+func WithPolicy(policy Policy) Option {
+	return func(o *options) {
+		o.policy = policy
+	}
+}
+
+// WithBackendName returns an Option that sets the name of the Cacher used as
+// the backend tag of the metrics. The default is the type name of the Cacher,
+// e.g. "*redis.Cache". The default name of a Cacher that wraps others, such as
+// compression.NewCache and tiered.NewCache, is the type name of the wrapper,
+// so set the name to tell apart the backends under the wrappers.
+func WithBackendName(name string) Option {
+	return func(o *options) {
+		o.backendName = name
+	}
+}
+
+// ErrorHandler is called with the name of the method of the Cacher, e.g.
+// "GetMulti", and the error returned by it.
+type ErrorHandler func(ctx context.Context, method string, err error)
+
+// WithErrorHandler returns an Option that calls the handler when the Cacher
+// returns an error, e.g. to log or count the failures of the backend. Errors
+// of the retrieval and saving are only passed to the handler, and the data is
+// retrieved from the datastore. The errors of GetMulti and SetMulti are
+// reported only if the Cacher implements ErrorCacher.
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
+
+// WithSingleflight returns an Option that coalesces the concurrent lookups of
+// the same keys missing in the cache. Only one Lookup is called for a key at a
+// time, and its result is shared with the other calls waiting for it even if
+// they look up different sets of keys. If the Lookup fails, or the key is
+// deferred by the datastore, the waiting calls look up the key by themselves.
+//
+// It does not coalesce the lookups with Refresh, which always retrieve the
+// entities from the datastore. The lookups after a Commit do not join the
+// lookups of the mutated keys started before it.
+func WithSingleflight() Option {
+	return func(o *options) {
+		o.singleflight = true
+	}
+}
+
+// WithStaleWhileRevalidate returns an Option that saves entities with the soft
+// expiration ttl, or the expiration of the Policy if it is not 0. After the
+// soft expiration, the cached entities are still used for stale, and they are
+// retrieved from the datastore in the background to refresh the cache. The
+// concurrent refreshes of the same keys are coalesced in this process. If the
+// Cacher implements Leaser, the refreshed entities replace only the cached
+// ones, so that the entities invalidated during the refresh are not saved.
+//
+// The entities are saved with the expiration ttl+stale if the Cacher
+// implements ItemSetter, like memory.Cache and redis.Cache. Otherwise, the
+// expiration of the Cacher should be longer than ttl. Cached data saved
+// without this option never expires softly.
+func WithStaleWhileRevalidate(ttl, stale time.Duration) Option {
+	return func(o *options) {
+		o.softExpiration = ttl
+		o.staleExpiration = stale
+	}
+}
+
+// WithEarlyRefresh returns an Option that refreshes the cached entities before
+// the soft expiration set by WithStaleWhileRevalidate by the probabilistic
+// early expiration (XFetch), so that hot keys are refreshed before they get
+// stale. A cached entity is refreshed in the background at the time t when
+// t - delta * beta * log(rand()) >= expiry, where delta is the duration of the
+// Lookup that retrieved it and rand() is uniform in (0, 1]. The beta 1 is a
+// good default, and a larger beta refreshes earlier.
+func WithEarlyRefresh(beta float64) Option {
+	return func(o *options) {
+		o.earlyRefresh = beta
+	}
+}
+
+// WithMaxValueSize returns an Option that does not save the entities whose
+// cached values are larger than size bytes, and records them as Skips. It is
+// useful for the backends that limit the size of an item, like memcache,
+// unless the Cacher is wrapped by chunk.NewCache.
+func WithMaxValueSize(size int) Option {
+	return func(o *options) {
+		o.maxValueSize = size
+	}
+}
+
 // UnaryClientInterceptor returns a new unary client interceptor that caches
 // gRPC calls of the Cloud Datastore using Cacher.
-func UnaryClientInterceptor(cacher Cacher) grpc.UnaryClientInterceptor {
+func UnaryClientInterceptor(cacher Cacher, opts ...Option) grpc.UnaryClientInterceptor {
+	o := options{
+		maxLookupRounds: defaultMaxLookupRounds,
+		maxVersionLag:   -1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.maxLookupRounds < 1 {
+		o.maxLookupRounds = 1
+	}
+
+	if o.backendName == "" {
+		o.backendName = backendName(cacher)
+	}
+	rec := recorder{backend: o.backendName}
+
+	report := func(ctx context.Context, method string, err error) {
+		if err != nil && o.errorHandler != nil {
+			o.errorHandler(ctx, method, err)
+		}
+	}
+	ecacher := AdaptCacher(cacher)
+	leaser, _ := cacher.(Leaser)
+	locker, _ := cacher.(Locker)
+	var versions *committedVersions
+	if o.maxVersionLag >= 0 {
+		versions = newCommittedVersions()
+	}
+	var flights *flightGroup
+	if o.singleflight {
+		flights = newFlightGroup()
+	}
+	var refreshes *flightGroup
+	if o.softExpiration > 0 {
+		refreshes = newFlightGroup()
+	}
+
+	// refreshStale retrieves the keys from the datastore in the background
+	// and saves them to the cache.
+	refreshStale := func(ctx context.Context, in *datastorepb.LookupRequest, keys []*datastorepb.Key, method string, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) {
+		keys, started, _, _ := refreshes.start(in.GetProjectId(), keys)
+		if len(keys) == 0 {
+			// Refreshed by others.
+			return
+		}
+		rec.recordKeys(ctx, Refreshes, keys)
+
+		req := proto.Clone(in).(*datastorepb.LookupRequest)
+		go func() {
+			defer refreshes.finish(in.GetProjectId(), started, nil, nil)
+
+			// The refresh continues after the call returns.
+			ctx, cancel := context.WithTimeout(detachedContext{ctx}, refreshTimeout)
+			defer cancel()
+
+			ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache.Refresh")
+			defer func() { span.End() }()
+			span.AddAttributes(trace.Int64Attribute("keys", int64(len(keys))))
+			if span.IsRecordingEvents() {
+				span.AddAttributes(trace.StringAttribute("kinds", kinds(keys)))
+			}
+
+			var leases map[string]uint64
+			if leaser != nil {
+				// The stale values are replaced only if they are still
+				// cached, so that the entities deleted by a concurrent
+				// Commit are not saved again. The keys evicted meanwhile
+				// are saved with leases.
+				leases = make(map[string]uint64, len(keys))
+				if ls, err := leaser.LeaseMulti(ctx, keys); err != nil {
+					report(ctx, "LeaseMulti", err)
+				} else {
+					for i, v := range ls {
+						if v != 0 {
+							leases[keyString(keys[i])] = v
+						}
+					}
+				}
+			}
+
+			for rounds := 0; rounds < o.maxLookupRounds && len(keys) > 0; rounds++ {
+				req.Keys = keys
+				out := &datastorepb.LookupResponse{}
+				start := time.Now()
+				if err := invoker(ctx, method, req, out, cc, opts...); err != nil {
+					span.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+					return
+				}
+
+				var tombstones []*datastorepb.EntityResult
+				if o.negativeCache {
+					tombstones = out.GetMissing()
+				} else if len(out.GetMissing()) > 0 {
+					// Delete the entities deleted without invalidation.
+					deleted := make([]*datastorepb.Key, len(out.GetMissing()))
+					for i, v := range out.GetMissing() {
+						deleted[i] = v.GetEntity().GetKey()
+					}
+					report(ctx, "DeleteMulti", deleteMulti(ctx, ecacher, rec, deleted))
+				}
+				items, skipped := o.limitSize(o.applyFreshness(o.applyPolicy(resultItems(out.GetFound(), tombstones)), start, time.Since(start)))
+				if len(skipped) > 0 {
+					// Delete the stale entities that are too large to be
+					// refreshed.
+					rec.recordKeys(ctx, Skips, skipped)
+					report(ctx, "DeleteMulti", deleteMulti(ctx, ecacher, rec, skipped))
+				}
+				if leases != nil {
+					items = leasedItems(items, leases, true)
+				}
+				// The cached data is overwritten unless it has a newer
+				// version.
+				report(ctx, setItemsMethod(cacher), setItems(ctx, cacher, items))
+				rec.recordFills(ctx, items)
+				keys = out.GetDeferred()
+			}
+		}()
+	}
+
 	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 		switch method {
 		case "/google.datastore.v1.Datastore/Lookup":
+			ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache.Lookup")
+			defer func() { span.End() }()
+
 			in := req.(*datastorepb.LookupRequest)
-			if in.GetReadOptions().GetTransaction() != nil {
-				// Don't use cache in transaction.
+			ctl := controlFromContext(ctx)
+			span.AddAttributes(
+				trace.StringAttribute("method", method),
+				trace.Int64Attribute("keys", int64(len(in.GetKeys()))),
+			)
+			if span.IsRecordingEvents() {
+				span.AddAttributes(trace.StringAttribute("kinds", kinds(in.GetKeys())))
+			}
+			if in.GetReadOptions().GetTransaction() != nil || ctl&controlBypass != 0 {
+				// Don't use cache in transaction or when bypassed.
+				span.AddAttributes(trace.BoolAttribute("cache", false))
 				return invoker(ctx, method, req, reply, cc, opts...)
 			}
 			out := reply.(*datastorepb.LookupResponse)
+			refresh := ctl&controlRefresh != 0
+			fill := ctl&controlReadOnly == 0
 
-			keys := in.GetKeys()
+			keys := withProject(in.GetProjectId(), in.GetKeys())
 			found := make([]*datastorepb.EntityResult, 0, len(keys))
-			var missing []*datastorepb.Key
+			var missing []*datastorepb.EntityResult
+			var hits, uncached, outdated, stale []*datastorepb.Key
+			now := time.Now()
+			rec.recordKeys(ctx, LookupKeys, keys)
 
-			cached := cacher.GetMulti(ctx, keys)
+			cacheable, nocache := o.cacheableKeys(keys)
+			var cached [][]byte
+			if len(cacheable) > 0 && !refresh {
+				var err error
+				cached, err = ecacher.GetMultiWithError(ctx, cacheable)
+				if err != nil {
+					report(ctx, "GetMulti", err)
+					cached = nil
+				}
+			}
 			for i, v := range cached {
 				if v == nil {
-					missing = append(missing, keys[i])
+					uncached = append(uncached, cacheable[i])
 					continue
 				}
 
-				var e datastorepb.EntityResult
-				if err := proto.Unmarshal(v, &e); err != nil {
-					missing = append(missing, keys[i])
+				e, isMissing, err := unmarshalResult(v)
+				if err != nil {
+					uncached = append(uncached, cacheable[i])
 					continue
 				}
-				found = append(found, &e)
+				if refreshes != nil && fill {
+					if _, f, _ := splitFreshness(v); f.stale(now, o.earlyRefresh) {
+						// Use the stale data while refreshing it.
+						stale = append(stale, cacheable[i])
+					}
+				}
+				if versions != nil && versions.outdated(cacheable[i], e.GetVersion(), o.maxVersionLag) {
+					outdated = append(outdated, cacheable[i])
+					uncached = append(uncached, cacheable[i])
+					continue
+				}
+				if isMissing {
+					missing = append(missing, e)
+				} else {
+					found = append(found, e)
+				}
+				hits = append(hits, cacheable[i])
+			}
+			if len(cached) == 0 {
+				// Not found all data.
+				uncached = cacheable
+			}
+			rec.recordKeys(ctx, Hits, hits)
+			rec.recordKeys(ctx, Misses, uncached)
+			span.AddAttributes(
+				trace.Int64Attribute("hits", int64(len(hits))),
+				trace.Int64Attribute("misses", int64(len(uncached))),
+				trace.Int64Attribute("uncacheable", int64(len(nocache))),
+			)
+			if refreshes != nil {
+				span.AddAttributes(trace.Int64Attribute("stale", int64(len(stale))))
+				if len(stale) > 0 {
+					refreshStale(ctx, in, stale, method, cc, invoker, opts...)
+				}
 			}
-			if len(keys) == len(found) {
+			if len(uncached) == 0 && len(nocache) == 0 {
 				// Found all data.
 				out.Found = found
+				out.Missing = missing
 				return nil
 			}
-			if len(cached) == 0 {
-				// Not found all data.
-				missing = keys
+
+			if len(outdated) > 0 {
+				// Delete the data known to be outdated to save new one.
+				report(ctx, "DeleteMulti", deleteMulti(ctx, ecacher, rec, outdated))
 			}
 
-			// Retrieve missing from Datastore.
-			in.Keys = missing
-			if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
-				return err
+			// Join the lookups of the same keys by other calls.
+			var joined []*datastorepb.Key
+			var joinedFlights []*flight
+			finishFlights := func() {}
+			if flights != nil && !refresh && len(uncached) > 0 {
+				var started map[string]*flight
+				uncached, started, joined, joinedFlights = flights.start(in.GetProjectId(), uncached)
+				finished := false
+				finishFlights = func() {
+					if !finished {
+						finished = true
+						flights.finish(in.GetProjectId(), started, found, missing)
+					}
+				}
+				// The waiting calls look up the keys by themselves if this
+				// lookup fails.
+				defer func() { finishFlights() }()
+				rec.recordKeys(ctx, Coalesced, joined)
+				span.AddAttributes(trace.Int64Attribute("coalesced", int64(len(joined))))
 			}
-			in.Keys = keys // Restore keys.
 
-			got := out.GetFound()
-			if got == nil {
-				// Not found all data in Datastore.
-				out.Found = found
-				return nil
+			var leases map[string]uint64
+			if leaser != nil && fill {
+				// Nothing is saved if the leases could not be acquired,
+				// except that the cached values are replaced on refresh.
+				leases = make(map[string]uint64, len(uncached))
+				if ls, err := leaser.LeaseMulti(ctx, uncached); err != nil {
+					report(ctx, "LeaseMulti", err)
+				} else {
+					for i, v := range ls {
+						if v != 0 {
+							leases[keyString(uncached[i])] = v
+						}
+					}
+				}
+			}
+			uncached = append(uncached, nocache...)
+
+			// Retrieve uncached from Datastore. Deferred keys are looked up
+			// again until all results are found or the rounds run out.
+			rounds := 0
+			lookup := func(keys []*datastorepb.Key) ([]*datastorepb.Key, error) {
+				for ; rounds < o.maxLookupRounds && len(keys) > 0; rounds++ {
+					reqKeys := in.Keys
+					in.Keys = keys
+					start := time.Now()
+					err := invoker(ctx, method, req, reply, cc, opts...)
+					in.Keys = reqKeys // Restore keys.
+					if err != nil {
+						return nil, err
+					}
+
+					// Save cache.
+					if fill {
+						var tombstones []*datastorepb.EntityResult
+						if o.negativeCache {
+							tombstones = out.GetMissing()
+						}
+						items, skipped := o.limitSize(o.applyFreshness(o.applyPolicy(resultItems(out.GetFound(), tombstones)), start, time.Since(start)))
+						rec.recordKeys(ctx, Skips, skipped)
+						if leases != nil {
+							items = leasedItems(items, leases, refresh)
+						}
+						// Without a Leaser, the cached data is overwritten
+						// unless it has a newer version.
+						report(ctx, setItemsMethod(cacher), setItems(ctx, cacher, items))
+						rec.recordFills(ctx, items)
+					}
+					found = append(found, out.GetFound()...)
+					missing = append(missing, out.GetMissing()...)
+					keys = out.GetDeferred()
+				}
+				return keys, nil
+			}
+			deferred, err := lookup(uncached)
+			if err != nil {
+				return err
 			}
-			out.Found = append(out.Found, found...)
 
-			// Save cache.
-			skeys := make([]*datastorepb.Key, 0, len(got))
-			values := make([][]byte, 0, len(got))
-			for _, v := range got {
-				if b, err := proto.Marshal(v); err == nil {
-					skeys = append(skeys, v.Entity.Key)
-					values = append(values, b)
+			if len(joined) > 0 {
+				// Finish the own lookups before waiting for the others so
+				// that the calls do not wait for each other.
+				finishFlights()
+				f, m, failed, err := wait(ctx, joined, joinedFlights)
+				if err != nil {
+					return err
+				}
+				found = append(found, f...)
+				missing = append(missing, m...)
+				// Look up the keys by itself if the others failed or the
+				// keys were deferred. They are not saved by a Leaser since
+				// they have no leases.
+				d, err := lookup(failed)
+				if err != nil {
+					return err
 				}
+				deferred = append(deferred, d...)
 			}
-			cacher.SetMulti(ctx, skeys, values)
+
+			out.Found = found
+			out.Missing = missing
+			out.Deferred = deferred
+			span.AddAttributes(
+				trace.Int64Attribute("rounds", int64(rounds)),
+				trace.Int64Attribute("deferred", int64(len(deferred))),
+			)
 
 			return nil
 
 		case "/google.datastore.v1.Datastore/Commit":
+			ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache.Commit")
+			defer func() { span.End() }()
+
+			in := req.(*datastorepb.CommitRequest)
+			ctl := controlFromContext(ctx)
+			skip := ctl&controlSkipInvalidation != 0
+			var keys []*datastorepb.Key
+			if !skip {
+				keys, _ = o.cacheableKeys(withProject(in.GetProjectId(), mutationKeys(in)))
+			}
+			locked := locker != nil && o.lockExpiration > 0 && len(keys) > 0
+			span.AddAttributes(
+				trace.StringAttribute("method", method),
+				trace.Int64Attribute("mutations", int64(len(in.GetMutations()))),
+				trace.Int64Attribute("invalidations", int64(len(keys))),
+				trace.BoolAttribute("locked", locked),
+			)
+			if span.IsRecordingEvents() {
+				span.AddAttributes(trace.StringAttribute("kinds", kinds(keys)))
+			}
+			if locked {
+				if err := locker.LockMulti(ctx, keys, o.lockExpiration); err != nil {
+					report(ctx, "LockMulti", err)
+					return err
+				}
+			}
+
 			err := invoker(ctx, method, req, reply, cc, opts...)
 			if err != nil {
+				if locked {
+					// Release locks. The locks will expire even if this fails.
+					report(ctx, "DeleteMulti", ecacher.DeleteMulti(ctx, keys))
+				}
 				return err
 			}
+			if versions != nil {
+				versions.update(in, reply.(*datastorepb.CommitResponse))
+			}
+			if flights != nil {
+				// The lookups in flight may return the entities before the
+				// commit.
+				flights.forget(in.GetProjectId(), mutationKeys(in))
+			}
 
-			in := req.(*datastorepb.CommitRequest)
-			keys := make([]*datastorepb.Key, 0, len(in.GetMutations()))
-			for _, v := range in.GetMutations() {
-				switch op := v.GetOperation().(type) {
-				case *datastorepb.Mutation_Update:
-					keys = append(keys, op.Update.Key)
-				case *datastorepb.Mutation_Upsert:
-					keys = append(keys, op.Upsert.Key)
-				case *datastorepb.Mutation_Delete:
-					keys = append(keys, op.Delete)
+			if len(keys) > 0 {
+				// Locked keys are not used until the locks expire even if the
+				// deletion fails.
+				if err := deleteMulti(ctx, ecacher, rec, keys); err != nil {
+					report(ctx, "DeleteMulti", err)
+					if !locked {
+						return err
+					}
 				}
 			}
-			if len(keys) > 0 {
-				return cacher.DeleteMulti(ctx, keys)
+			if o.writeThrough && !skip && ctl&(controlBypass|controlReadOnly) == 0 {
+				items, skipped := o.limitSize(o.applyFreshness(o.applyPolicy(committedItems(in, reply.(*datastorepb.CommitResponse))), time.Now(), 0))
+				rec.recordKeys(ctx, Skips, skipped)
+				report(ctx, setItemsMethod(cacher), setItems(ctx, cacher, items))
+				rec.recordFills(ctx, items)
+				span.AddAttributes(trace.Int64Attribute("fills", int64(len(items))))
 			}
 
 			return nil
@@ -151,3 +806,281 @@ func UnaryClientInterceptor(cacher Cacher) grpc.UnaryClientInterceptor {
 		return invoker(ctx, method, req, reply, cc, opts...)
 	}
 }
+
+// cacheableKeys splits the keys into the keys cached by the policy and the
+// others.
+func (o *options) cacheableKeys(keys []*datastorepb.Key) (cacheable, others []*datastorepb.Key) {
+	if o.policy == nil {
+		return keys, nil
+	}
+	for _, k := range keys {
+		if ok, _ := o.policy(keyPolicyArgs(k)); ok {
+			cacheable = append(cacheable, k)
+		} else {
+			others = append(others, k)
+		}
+	}
+	return cacheable, others
+}
+
+// applyPolicy removes the items that are not cached by the policy, and sets
+// the expirations of the others.
+func (o *options) applyPolicy(items []*Item) []*Item {
+	if o.policy == nil {
+		return items
+	}
+	ret := items[:0]
+	for _, v := range items {
+		if ok, exp := o.policy(keyPolicyArgs(v.Key)); ok {
+			v.Expiration = exp
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// applyFreshness sets the soft expirations of WithStaleWhileRevalidate to the
+// items retrieved at now in delta, and extends their expirations for stale.
+func (o *options) applyFreshness(items []*Item, now time.Time, delta time.Duration) []*Item {
+	if o.softExpiration <= 0 {
+		return items
+	}
+	for _, v := range items {
+		ttl := v.Expiration
+		if ttl == 0 {
+			ttl = o.softExpiration
+		}
+		v.Value = withFreshness(v.Value, freshness{expiry: now.Add(ttl), delta: delta})
+		v.Expiration = ttl + o.staleExpiration
+	}
+	return items
+}
+
+// limitSize removes the items larger than WithMaxValueSize, and returns the
+// keys of them.
+func (o *options) limitSize(items []*Item) ([]*Item, []*datastorepb.Key) {
+	if o.maxValueSize <= 0 {
+		return items, nil
+	}
+	var skipped []*datastorepb.Key
+	ret := items[:0]
+	for _, v := range items {
+		if len(v.Value) > o.maxValueSize {
+			skipped = append(skipped, v.Key)
+		} else {
+			ret = append(ret, v)
+		}
+	}
+	return ret, skipped
+}
+
+// keyPolicyArgs returns the namespace and the kind of the key.
+func keyPolicyArgs(key *datastorepb.Key) (namespace, kind string) {
+	path := key.GetPath()
+	if len(path) > 0 {
+		kind = path[len(path)-1].GetKind()
+	}
+	return key.GetPartitionId().GetNamespaceId(), kind
+}
+
+// resultItems returns the items to save the found entities and the tombstones
+// of the missing entities.
+func resultItems(found, missing []*datastorepb.EntityResult) []*Item {
+	items := make([]*Item, 0, len(found)+len(missing))
+	for _, v := range found {
+		if b, err := marshalResult(v, false); err == nil {
+			items = append(items, &Item{Key: v.Entity.Key, Value: b, Version: v.Version})
+		}
+	}
+	for _, v := range missing {
+		if b, err := marshalResult(v, true); err == nil {
+			items = append(items, &Item{Key: v.Entity.Key, Value: b, Version: v.Version})
+		}
+	}
+	return items
+}
+
+// setItems saves the items by ItemSetter if the Cacher implements it, or by
+// SetMultiWithError.
+func setItems(ctx context.Context, cacher Cacher, items []*Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if setter, ok := cacher.(ItemSetter); ok {
+		return setter.SetItems(ctx, items)
+	}
+	keys := make([]*datastorepb.Key, len(items))
+	values := make([][]byte, len(items))
+	for i, v := range items {
+		keys[i] = v.Key
+		values[i] = v.Value
+	}
+	return AdaptCacher(cacher).SetMultiWithError(ctx, keys, values)
+}
+
+// backendName returns the type name of the Cacher, or of the Cacher passed to
+// ForwardLeases instead of the type that forwards the leases.
+func backendName(cacher Cacher) string {
+	switch c := cacher.(type) {
+	case *leaseForwarder:
+		return fmt.Sprintf("%T", c.ItemCacher)
+	case *lockForwarder:
+		return fmt.Sprintf("%T", c.ItemCacher)
+	}
+	return fmt.Sprintf("%T", cacher)
+}
+
+// setItemsMethod returns the name of the method used by setItems.
+func setItemsMethod(cacher Cacher) string {
+	if _, ok := cacher.(ItemSetter); ok {
+		return "SetItems"
+	}
+	return "SetMulti"
+}
+
+// leasedItems returns only the items whose leases are acquired with the
+// leases. If replace is true, the other items are also returned to replace
+// the cached values.
+func leasedItems(items []*Item, leases map[string]uint64, replace bool) []*Item {
+	leased := items[:0]
+	for _, v := range items {
+		if l := leases[keyString(v.Key)]; l != 0 {
+			v.Lease = l
+			leased = append(leased, v)
+		} else if replace {
+			v.Replace = true
+			leased = append(leased, v)
+		}
+	}
+	return leased
+}
+
+// kinds returns the sorted kinds of the keys separated by commas.
+func kinds(keys []*datastorepb.Key) string {
+	seen := make(map[string]bool)
+	var ret []string
+	for _, k := range keys {
+		if _, kind := keyPolicyArgs(k); !seen[kind] {
+			seen[kind] = true
+			ret = append(ret, kind)
+		}
+	}
+	sort.Strings(ret)
+	return strings.Join(ret, ",")
+}
+
+// deleteMulti deletes the keys from the cache and records the invalidations.
+func deleteMulti(ctx context.Context, cacher ErrorCacher, rec recorder, keys []*datastorepb.Key) error {
+	rec.recordKeys(ctx, Invalidations, keys)
+	err := cacher.DeleteMulti(ctx, keys)
+	if err != nil {
+		rec.recordKeys(ctx, InvalidationErrors, keys)
+	}
+	return err
+}
+
+// keyString returns a string that identifies the key in the cache. The
+// project ID is ignored since keys in results of the datastore have it while
+// keys in requests may not.
+func keyString(key *datastorepb.Key) string {
+	k := datastorepb.Key{
+		PartitionId: &datastorepb.PartitionId{NamespaceId: key.GetPartitionId().GetNamespaceId()},
+		Path:        key.GetPath(),
+	}
+	return k.String()
+}
+
+// withProject returns the keys with the project ID so that the Cacher can
+// distinguish the same keys in different projects. Keys in requests may not
+// have the project ID of the request, and the copies are returned for them.
+func withProject(projectID string, keys []*datastorepb.Key) []*datastorepb.Key {
+	if projectID == "" {
+		return keys
+	}
+	ret := make([]*datastorepb.Key, len(keys))
+	for i, k := range keys {
+		if k.GetPartitionId().GetProjectId() != "" {
+			ret[i] = k
+			continue
+		}
+		ret[i] = &datastorepb.Key{
+			PartitionId: &datastorepb.PartitionId{
+				ProjectId:   projectID,
+				NamespaceId: k.GetPartitionId().GetNamespaceId(),
+			},
+			Path: k.GetPath(),
+		}
+	}
+	return ret
+}
+
+// mutationKeys returns the keys to be deleted from the cache by the commit.
+func mutationKeys(in *datastorepb.CommitRequest) []*datastorepb.Key {
+	keys := make([]*datastorepb.Key, 0, len(in.GetMutations()))
+	for _, v := range in.GetMutations() {
+		switch op := v.GetOperation().(type) {
+		case *datastorepb.Mutation_Insert:
+			// An incomplete key can't be cached, but a complete key may be
+			// cached as a tombstone.
+			if isComplete(op.Insert.Key) {
+				keys = append(keys, op.Insert.Key)
+			}
+		case *datastorepb.Mutation_Update:
+			keys = append(keys, op.Update.Key)
+		case *datastorepb.Mutation_Upsert:
+			keys = append(keys, op.Upsert.Key)
+		case *datastorepb.Mutation_Delete:
+			keys = append(keys, op.Delete)
+		}
+	}
+	return keys
+}
+
+// committedItems returns the items to save the entities written by the commit
+// with the versions of the mutation results.
+func committedItems(in *datastorepb.CommitRequest, out *datastorepb.CommitResponse) []*Item {
+	results := out.GetMutationResults()
+	if len(results) != len(in.GetMutations()) {
+		return nil
+	}
+
+	items := make([]*Item, 0, len(results))
+	for i, v := range in.GetMutations() {
+		var e *datastorepb.Entity
+		switch op := v.GetOperation().(type) {
+		case *datastorepb.Mutation_Insert:
+			e = op.Insert
+		case *datastorepb.Mutation_Update:
+			e = op.Update
+		case *datastorepb.Mutation_Upsert:
+			e = op.Upsert
+		default:
+			continue
+		}
+
+		key := e.GetKey()
+		if k := results[i].GetKey(); k != nil {
+			// Allocated key.
+			key = k
+		}
+		if !isComplete(key) {
+			continue
+		}
+		key = withProject(in.GetProjectId(), []*datastorepb.Key{key})[0]
+
+		b, err := marshalResult(&datastorepb.EntityResult{
+			Entity:  &datastorepb.Entity{Key: key, Properties: e.GetProperties()},
+			Version: results[i].GetVersion(),
+		}, false)
+		if err == nil {
+			items = append(items, &Item{Key: key, Value: b, Version: results[i].GetVersion()})
+		}
+	}
+	return items
+}
+
+// isComplete reports whether the key has an ID or a name.
+func isComplete(key *datastorepb.Key) bool {
+	path := key.GetPath()
+	return len(path) > 0 && path[len(path)-1].GetIdType() != nil
+}
@@ -11,11 +11,15 @@ import (
 	"os/exec"
 	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/golang/protobuf/proto"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	"go.opencensus.io/trace"
 	"google.golang.org/api/option"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 	"google.golang.org/grpc"
@@ -29,11 +33,11 @@ func ExampleUnaryClientInterceptor() {
 	)
 }
 
-func datastoreClientWithInterceptor(t *testing.T, cacher Cacher) *datastore.Client {
+func datastoreClientWithInterceptor(t *testing.T, cacher Cacher, opts ...Option) *datastore.Client {
 	t.Helper()
 
 	client, err := datastore.NewClient(context.Background(), "",
-		option.WithGRPCDialOption(grpc.WithUnaryInterceptor(UnaryClientInterceptor(cacher))),
+		option.WithGRPCDialOption(grpc.WithUnaryInterceptor(UnaryClientInterceptor(cacher, opts...))),
 	)
 	if err != nil {
 		t.Fatal(err)
@@ -222,6 +226,954 @@ func TestGetMulti(t *testing.T) {
 	}
 }
 
+func TestGetMultiWithNegativeCache(t *testing.T) {
+	defer resetEmulator()
+
+	tests := []struct {
+		name       string
+		datastore  map[string]entity
+		mockValues [][]byte
+		keys       []string
+		want       []entity
+		wantErr    error
+		wantSet    []string
+	}{
+		{
+			name: "datastore only",
+			datastore: map[string]entity{
+				"1": {Data: "aaa"},
+			},
+			keys:    []string{"1", "2"},
+			want:    []entity{{Data: "aaa"}, {}},
+			wantErr: datastore.MultiError{nil, datastore.ErrNoSuchEntity},
+			wantSet: []string{"1", "2"},
+		},
+		{
+			name: "cache only",
+			mockValues: [][]byte{
+				marshalCache("TestGetMultiWithNegativeCache/cache_only", "1", "aaa"),
+				marshalTombstone("TestGetMultiWithNegativeCache/cache_only", "2"),
+			},
+			keys:    []string{"1", "2"},
+			want:    []entity{{Data: "aaa"}, {}},
+			wantErr: datastore.MultiError{nil, datastore.ErrNoSuchEntity},
+		},
+		{
+			name: "mixed/tombstone,datastore,no such entity",
+			datastore: map[string]entity{
+				"2": {Data: "bbb"},
+			},
+			mockValues: [][]byte{
+				marshalTombstone("TestGetMultiWithNegativeCache/mixed/tombstone,datastore,no_such_entity", "1"),
+				nil,
+				nil,
+			},
+			keys:    []string{"1", "2", "3"},
+			want:    []entity{{}, {Data: "bbb"}, {}},
+			wantErr: datastore.MultiError{datastore.ErrNoSuchEntity, nil, datastore.ErrNoSuchEntity},
+			wantSet: []string{"2", "3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &mock{values: tt.mockValues}
+			client := datastoreClientWithInterceptor(t, m, WithNegativeCache())
+			defer client.Close()
+
+			putEntities(t, tt.datastore)
+
+			keys := make([]*datastore.Key, len(tt.keys))
+			for i, k := range tt.keys {
+				keys[i] = datastore.NameKey(t.Name(), k, nil)
+			}
+			dst := make([]entity, len(tt.keys))
+			err := client.GetMulti(context.Background(), keys, dst)
+			if merr, ok := err.(datastore.MultiError); ok {
+				if !reflect.DeepEqual(merr, tt.wantErr) {
+					t.Fatalf("client.GetMulti() error =  %v, wantErr %v", merr, tt.wantErr)
+				}
+			} else {
+				if err != tt.wantErr {
+					t.Fatalf("client.GetMulti() error =  %v, wantErr %v", err, tt.wantErr)
+				}
+			}
+			if !reflect.DeepEqual(dst, tt.want) {
+				t.Errorf("client.GetMulti() dst = %v, want %v", dst, tt.want)
+			}
+			if !reflect.DeepEqual(m.setKeys, tt.wantSet) {
+				t.Errorf("called cacher.SetMulti() with keys = %v, want %v", m.setKeys, tt.wantSet)
+			}
+		})
+	}
+}
+
+func TestLookupDeferred(t *testing.T) {
+	tests := []struct {
+		name         string
+		rounds       int
+		deferred     int
+		wantFound    []string
+		wantDeferred []string
+		wantSet      []string
+		wantCalls    int
+	}{
+		{
+			name:      "resolved",
+			rounds:    3,
+			deferred:  2,
+			wantFound: []string{"1", "2", "3"},
+			wantSet:   []string{"1", "2", "3"},
+			wantCalls: 3,
+		},
+		{
+			name:         "rounds exceeded",
+			rounds:       2,
+			deferred:     2,
+			wantFound:    []string{"1", "2"},
+			wantDeferred: []string{"3"},
+			wantSet:      []string{"1", "2"},
+			wantCalls:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				calls++
+				in := req.(*datastorepb.LookupRequest)
+				out := reply.(*datastorepb.LookupResponse)
+				out.Reset()
+				for i, k := range in.GetKeys() {
+					if i > 0 && calls <= tt.deferred {
+						// Return only the first key, like a large response.
+						out.Deferred = append(out.Deferred, k)
+						continue
+					}
+					out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+				}
+				return nil
+			}
+
+			m := &mock{}
+			req := &datastorepb.LookupRequest{}
+			for _, k := range []string{"1", "2", "3"} {
+				req.Keys = append(req.Keys, &datastorepb.Key{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Name{Name: k}}},
+				})
+			}
+			out := &datastorepb.LookupResponse{}
+			err := UnaryClientInterceptor(m, WithMaxLookupRounds(tt.rounds))(context.Background(), "/google.datastore.v1.Datastore/Lookup", req, out, nil, invoker)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var found, deferred []string
+			for _, v := range out.GetFound() {
+				found = append(found, v.GetEntity().GetKey().GetPath()[0].GetName())
+			}
+			for _, v := range out.GetDeferred() {
+				deferred = append(deferred, v.GetPath()[0].GetName())
+			}
+			if !reflect.DeepEqual(found, tt.wantFound) {
+				t.Errorf("found = %v, want %v", found, tt.wantFound)
+			}
+			if !reflect.DeepEqual(deferred, tt.wantDeferred) {
+				t.Errorf("deferred = %v, want %v", deferred, tt.wantDeferred)
+			}
+			if !reflect.DeepEqual(m.setKeys, tt.wantSet) {
+				t.Errorf("called cacher.SetMulti() with keys = %v, want %v", m.setKeys, tt.wantSet)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Lookup is called %d times, want %d", calls, tt.wantCalls)
+			}
+			if len(req.Keys) != 3 {
+				t.Errorf("request keys are not restored: %v", req.Keys)
+			}
+		})
+	}
+}
+
+func TestLookupWithLease(t *testing.T) {
+	tests := []struct {
+		name      string
+		leases    []uint64
+		leaseErr  error
+		wantItems map[string]uint64
+	}{
+		{
+			name:      "leased",
+			leases:    []uint64{1, 2},
+			wantItems: map[string]uint64{"1": 1, "2": 2},
+		},
+		{
+			name:      "partially leased",
+			leases:    []uint64{0, 2},
+			wantItems: map[string]uint64{"2": 2},
+		},
+		{
+			name:     "lease error",
+			leaseErr: errors.New("lease error"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				out := reply.(*datastorepb.LookupResponse)
+				for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+					out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+				}
+				return nil
+			}
+
+			m := &leaseMock{leases: tt.leases, err: tt.leaseErr}
+			req := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{newKey("1"), newKey("2")}}
+			err := UnaryClientInterceptor(m)(context.Background(), "/google.datastore.v1.Datastore/Lookup", req, &datastorepb.LookupResponse{}, nil, invoker)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.setKeys) > 0 {
+				t.Errorf("called cacher.SetMulti() with keys = %v", m.setKeys)
+			}
+			if !reflect.DeepEqual(m.items, tt.wantItems) {
+				t.Errorf("called cacher.SetItems() with leases = %v, want %v", m.items, tt.wantItems)
+			}
+		})
+	}
+}
+
+func TestLookupWithMaxVersionLag(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []Option
+		wantDel     []*datastore.Key
+		wantLookups int
+	}{
+		{
+			name:        "disabled",
+			wantDel:     []*datastore.Key{datastore.NameKey("k", "1", nil)},
+			wantLookups: 0,
+		},
+		{
+			name:        "outdated",
+			opts:        []Option{WithMaxVersionLag(0)},
+			wantDel:     []*datastore.Key{datastore.NameKey("k", "1", nil), datastore.NameKey("k", "1", nil)},
+			wantLookups: 1,
+		},
+		{
+			name:        "within lag",
+			opts:        []Option{WithMaxVersionLag(5)},
+			wantDel:     []*datastore.Key{datastore.NameKey("k", "1", nil)},
+			wantLookups: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lookups := 0
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				switch out := reply.(type) {
+				case *datastorepb.CommitResponse:
+					out.MutationResults = []*datastorepb.MutationResult{{Version: 15}}
+				case *datastorepb.LookupResponse:
+					lookups++
+					for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+						out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}, Version: 15})
+					}
+				}
+				return nil
+			}
+
+			cached, _ := marshalResult(&datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: newKey("1")}, Version: 10}, false)
+			m := &mock{values: [][]byte{cached}}
+			interceptor := UnaryClientInterceptor(m, tt.opts...)
+			commit := &datastorepb.CommitRequest{Mutations: []*datastorepb.Mutation{
+				{Operation: &datastorepb.Mutation_Upsert{Upsert: &datastorepb.Entity{Key: newKey("1")}}},
+			}}
+			if err := interceptor(context.Background(), "/google.datastore.v1.Datastore/Commit", commit, &datastorepb.CommitResponse{}, nil, invoker); err != nil {
+				t.Fatal(err)
+			}
+			lookup := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{newKey("1")}}
+			if err := interceptor(context.Background(), "/google.datastore.v1.Datastore/Lookup", lookup, &datastorepb.LookupResponse{}, nil, invoker); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m.delKeys, tt.wantDel) {
+				t.Errorf("called cacher.DeleteMulti() with keys = %v, want %v", m.delKeys, tt.wantDel)
+			}
+			if lookups != tt.wantLookups {
+				t.Errorf("Lookup is called %d times, want %d", lookups, tt.wantLookups)
+			}
+		})
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	policy := func(namespace, kind string) (bool, time.Duration) {
+		switch {
+		case kind == "Counter":
+			return false, 0
+		case kind == "Config" && namespace == "ns":
+			return true, time.Hour
+		}
+		return true, 0
+	}
+	keys := []*datastorepb.Key{
+		newKey("1"),
+		{Path: []*datastorepb.Key_PathElement{{Kind: "Counter", IdType: &datastorepb.Key_PathElement_Name{Name: "2"}}}},
+		{
+			PartitionId: &datastorepb.PartitionId{NamespaceId: "ns"},
+			Path:        []*datastorepb.Key_PathElement{{Kind: "Config", IdType: &datastorepb.Key_PathElement_Name{Name: "3"}}},
+		},
+	}
+
+	var requested []string
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		switch out := reply.(type) {
+		case *datastorepb.CommitResponse:
+			for range req.(*datastorepb.CommitRequest).GetMutations() {
+				out.MutationResults = append(out.MutationResults, &datastorepb.MutationResult{Version: 1})
+			}
+		case *datastorepb.LookupResponse:
+			for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+				requested = append(requested, k.Path[0].GetName())
+				out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+			}
+		}
+		return nil
+	}
+
+	m := &leaseMock{leases: []uint64{1, 2}}
+	interceptor := UnaryClientInterceptor(m, WithPolicy(policy), WithWriteThrough())
+	lookup := &datastorepb.LookupRequest{Keys: keys}
+	out := &datastorepb.LookupResponse{}
+	if err := interceptor(context.Background(), "/google.datastore.v1.Datastore/Lookup", lookup, out, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1", "3", "2"}; !reflect.DeepEqual(requested, want) {
+		t.Errorf("looked up keys = %v, want %v", requested, want)
+	}
+	if len(out.GetFound()) != 3 {
+		t.Errorf("found %d entities, want 3", len(out.GetFound()))
+	}
+	if want := map[string]time.Duration{"1": 0, "3": time.Hour}; !reflect.DeepEqual(m.expirations, want) {
+		t.Errorf("called cacher.SetItems() with expirations = %v, want %v", m.expirations, want)
+	}
+
+	m.expirations = nil
+	var mutations []*datastorepb.Mutation
+	for _, k := range keys {
+		mutations = append(mutations, &datastorepb.Mutation{Operation: &datastorepb.Mutation_Upsert{Upsert: &datastorepb.Entity{Key: k}}})
+	}
+	commit := &datastorepb.CommitRequest{Mutations: mutations}
+	if err := interceptor(context.Background(), "/google.datastore.v1.Datastore/Commit", commit, &datastorepb.CommitResponse{}, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	if want := []*datastore.Key{datastore.NameKey("k", "1", nil), datastore.NameKey("Config", "3", nil)}; !reflect.DeepEqual(m.delKeys, want) {
+		t.Errorf("called cacher.DeleteMulti() with keys = %v, want %v", m.delKeys, want)
+	}
+	if want := map[string]time.Duration{"1": 0, "3": time.Hour}; !reflect.DeepEqual(m.expirations, want) {
+		t.Errorf("called cacher.SetItems() with expirations = %v, want %v", m.expirations, want)
+	}
+}
+
+func TestContextControl(t *testing.T) {
+	tests := []struct {
+		name        string
+		ctx         func(context.Context) context.Context
+		wantLookup  []string
+		wantFilled  map[string]uint64
+		wantDel     []*datastore.Key
+		wantWritten map[string]uint64
+	}{
+		{
+			name:        "default",
+			ctx:         func(ctx context.Context) context.Context { return ctx },
+			wantLookup:  []string{"2"},
+			wantFilled:  map[string]uint64{"2": 1},
+			wantDel:     []*datastore.Key{datastore.NameKey("k", "1", nil)},
+			wantWritten: map[string]uint64{"1": 0},
+		},
+		{
+			name:       "bypass",
+			ctx:        Bypass,
+			wantLookup: []string{"1", "2"},
+			wantDel:    []*datastore.Key{datastore.NameKey("k", "1", nil)},
+		},
+		{
+			name:        "refresh",
+			ctx:         Refresh,
+			wantLookup:  []string{"1", "2"},
+			wantFilled:  map[string]uint64{"1": 1, "2": 0},
+			wantDel:     []*datastore.Key{datastore.NameKey("k", "1", nil)},
+			wantWritten: map[string]uint64{"1": 0},
+		},
+		{
+			name:       "read only",
+			ctx:        ReadOnly,
+			wantLookup: []string{"2"},
+			wantDel:    []*datastore.Key{datastore.NameKey("k", "1", nil)},
+		},
+		{
+			name:       "skip invalidation",
+			ctx:        SkipInvalidation,
+			wantLookup: []string{"2"},
+			wantFilled: map[string]uint64{"2": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requested []string
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				switch out := reply.(type) {
+				case *datastorepb.CommitResponse:
+					out.MutationResults = []*datastorepb.MutationResult{{Version: 1}}
+				case *datastorepb.LookupResponse:
+					for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+						requested = append(requested, k.Path[0].GetName())
+						out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+					}
+				}
+				return nil
+			}
+
+			cached, _ := marshalResult(&datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: newKey("1")}}, false)
+			m := &leaseMock{mock: mock{values: [][]byte{cached, nil}}, leases: []uint64{1}}
+			interceptor := UnaryClientInterceptor(m, WithWriteThrough())
+			ctx := tt.ctx(context.Background())
+
+			lookup := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{newKey("1"), newKey("2")}}
+			out := &datastorepb.LookupResponse{}
+			if err := interceptor(ctx, "/google.datastore.v1.Datastore/Lookup", lookup, out, nil, invoker); err != nil {
+				t.Fatal(err)
+			}
+			if len(out.GetFound()) != 2 {
+				t.Errorf("found %d entities, want 2", len(out.GetFound()))
+			}
+			if !reflect.DeepEqual(requested, tt.wantLookup) {
+				t.Errorf("looked up keys = %v, want %v", requested, tt.wantLookup)
+			}
+			if !reflect.DeepEqual(m.items, tt.wantFilled) {
+				t.Errorf("called cacher.SetItems() with leases = %v, want %v", m.items, tt.wantFilled)
+			}
+
+			m.items = nil
+			commit := &datastorepb.CommitRequest{Mutations: []*datastorepb.Mutation{
+				{Operation: &datastorepb.Mutation_Upsert{Upsert: &datastorepb.Entity{Key: newKey("1")}}},
+			}}
+			if err := interceptor(ctx, "/google.datastore.v1.Datastore/Commit", commit, &datastorepb.CommitResponse{}, nil, invoker); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(m.delKeys, tt.wantDel) {
+				t.Errorf("called cacher.DeleteMulti() with keys = %v, want %v", m.delKeys, tt.wantDel)
+			}
+			if !reflect.DeepEqual(m.items, tt.wantWritten) {
+				t.Errorf("called cacher.SetItems() with leases = %v, want %v", m.items, tt.wantWritten)
+			}
+		})
+	}
+}
+
+func TestLookupWithProject(t *testing.T) {
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		out := reply.(*datastorepb.LookupResponse)
+		for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+			out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+		}
+		return nil
+	}
+
+	m := &mock{}
+	req := &datastorepb.LookupRequest{ProjectId: "p", Keys: []*datastorepb.Key{newKey("1")}}
+	if err := UnaryClientInterceptor(m)(context.Background(), "/google.datastore.v1.Datastore/Lookup", req, &datastorepb.LookupResponse{}, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.getKeys) != 1 || m.getKeys[0].GetPartitionId().GetProjectId() != "p" {
+		t.Errorf("called cacher.GetMulti() with keys = %v, want keys in project p", m.getKeys)
+	}
+	if req.Keys[0].GetPartitionId() != nil {
+		t.Errorf("request key is modified: %v", req.Keys[0])
+	}
+}
+
+func TestLookupWithSingleflight(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantLookups [][]string
+		wantFound   [][]string
+		wantErr     error
+	}{
+		{
+			name:        "shared",
+			wantLookups: [][]string{{"1", "2"}, {"3"}},
+			wantFound:   [][]string{{"1", "2"}, {"3", "2"}},
+		},
+		{
+			name:        "failed",
+			err:         errors.New("lookup error"),
+			wantLookups: [][]string{{"1", "2"}, {"3"}, {"2"}},
+			wantFound:   [][]string{nil, {"3", "2"}},
+			wantErr:     errors.New("lookup error"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var lookups [][]string
+			started := make(chan struct{})
+			release := make(chan struct{})
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				var names []string
+				for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+					names = append(names, k.Path[0].GetName())
+				}
+				mu.Lock()
+				lookups = append(lookups, names)
+				n := len(lookups)
+				mu.Unlock()
+
+				switch n {
+				case 1:
+					// Block the first lookup until the second call joins it.
+					close(started)
+					<-release
+					if tt.err != nil {
+						return tt.err
+					}
+				case 2:
+					close(release)
+				}
+				out := reply.(*datastorepb.LookupResponse)
+				out.Reset()
+				for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+					out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+				}
+				return nil
+			}
+
+			interceptor := UnaryClientInterceptor(&syncMock{}, WithSingleflight())
+			lookup := func(names ...string) ([]string, error) {
+				req := &datastorepb.LookupRequest{}
+				for _, name := range names {
+					req.Keys = append(req.Keys, newKey(name))
+				}
+				out := &datastorepb.LookupResponse{}
+				if err := interceptor(context.Background(), "/google.datastore.v1.Datastore/Lookup", req, out, nil, invoker); err != nil {
+					return nil, err
+				}
+				var found []string
+				for _, v := range out.GetFound() {
+					found = append(found, v.GetEntity().GetKey().GetPath()[0].GetName())
+				}
+				return found, nil
+			}
+
+			var found1 []string
+			var err1 error
+			done := make(chan struct{})
+			go func() {
+				found1, err1 = lookup("1", "2")
+				close(done)
+			}()
+			<-started
+			found2, err := lookup("2", "3")
+			if err != nil {
+				t.Fatal(err)
+			}
+			<-done
+
+			if !reflect.DeepEqual(err1, tt.wantErr) {
+				t.Errorf("first lookup error = %v, want %v", err1, tt.wantErr)
+			}
+			if got := [][]string{found1, found2}; !reflect.DeepEqual(got, tt.wantFound) {
+				t.Errorf("found = %v, want %v", got, tt.wantFound)
+			}
+			if !reflect.DeepEqual(lookups, tt.wantLookups) {
+				t.Errorf("Lookup is called with keys = %v, want %v", lookups, tt.wantLookups)
+			}
+		})
+	}
+}
+
+func TestLookupWithStaleWhileRevalidate(t *testing.T) {
+	cached, _ := marshalResult(&datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: newKey("1")}}, false)
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		value       []byte
+		beta        float64
+		wantRefresh bool
+	}{
+		{
+			name:  "fresh",
+			ctx:   context.Background(),
+			value: withFreshness(cached, freshness{expiry: time.Now().Add(1 * time.Hour), delta: 1 * time.Millisecond}),
+			beta:  1,
+		},
+		{
+			name:        "stale",
+			ctx:         context.Background(),
+			value:       withFreshness(cached, freshness{expiry: time.Now().Add(-1 * time.Second)}),
+			wantRefresh: true,
+		},
+		{
+			name:        "early refresh",
+			ctx:         context.Background(),
+			value:       withFreshness(cached, freshness{expiry: time.Now().Add(1 * time.Hour), delta: 1 * time.Second}),
+			beta:        1e9,
+			wantRefresh: true,
+		},
+		{
+			name:  "read only",
+			ctx:   ReadOnly(context.Background()),
+			value: withFreshness(cached, freshness{expiry: time.Now().Add(-1 * time.Second)}),
+		},
+		{
+			name:  "without soft expiration",
+			ctx:   context.Background(),
+			value: cached,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			refreshed := make(chan []*datastorepb.Key, 1)
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				out := reply.(*datastorepb.LookupResponse)
+				for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+					out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+				}
+				refreshed <- req.(*datastorepb.LookupRequest).GetKeys()
+				return nil
+			}
+
+			m := &syncMock{mock: mock{values: [][]byte{tt.value}}}
+			interceptor := UnaryClientInterceptor(m, WithStaleWhileRevalidate(1*time.Minute, 1*time.Hour), WithEarlyRefresh(tt.beta))
+			req := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{newKey("1")}}
+			out := &datastorepb.LookupResponse{}
+			if err := interceptor(tt.ctx, "/google.datastore.v1.Datastore/Lookup", req, out, nil, invoker); err != nil {
+				t.Fatal(err)
+			}
+			if len(out.GetFound()) != 1 {
+				t.Errorf("found = %v, want the cached entity", out.GetFound())
+			}
+
+			select {
+			case keys := <-refreshed:
+				if !tt.wantRefresh {
+					t.Fatalf("refreshed keys = %v, want no refresh", keys)
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.wantRefresh {
+					t.Fatal("not refreshed")
+				}
+				return
+			}
+
+			// Wait for the cache to be saved.
+			for i := 0; ; i++ {
+				m.mu.Lock()
+				values := m.setValues
+				m.mu.Unlock()
+				if len(values) > 0 {
+					_, f, err := splitFreshness(values[0])
+					if err != nil || f.expiry.Before(time.Now()) {
+						t.Errorf("refreshed value has soft expiration %v, %v", f.expiry, err)
+					}
+					break
+				}
+				if i > 100 {
+					t.Fatal("refreshed value is not saved")
+				}
+				time.Sleep(1 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestLookupWithStaleWhileRevalidateExpiration(t *testing.T) {
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		out := reply.(*datastorepb.LookupResponse)
+		for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+			out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+		}
+		return nil
+	}
+
+	m := &leaseMock{leases: []uint64{1, 2}}
+	policy := func(namespace, kind string) (bool, time.Duration) {
+		return true, 0
+	}
+	req := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{newKey("1"), newKey("2")}}
+	err := UnaryClientInterceptor(m, WithPolicy(policy), WithStaleWhileRevalidate(1*time.Minute, 1*time.Hour))(context.Background(), "/google.datastore.v1.Datastore/Lookup", req, &datastorepb.LookupResponse{}, nil, invoker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]time.Duration{"1": 61 * time.Minute, "2": 61 * time.Minute}
+	if !reflect.DeepEqual(m.expirations, want) {
+		t.Errorf("called cacher.SetItems() with expirations = %v, want %v", m.expirations, want)
+	}
+}
+
+func TestLookupWithMaxValueSize(t *testing.T) {
+	if err := view.Register(SkipsView); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(SkipsView)
+
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		out := reply.(*datastorepb.LookupResponse)
+		for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+			e := &datastorepb.Entity{Key: k}
+			if k.Path[0].GetName() == "2" {
+				e.Properties = map[string]*datastorepb.Value{
+					"p": {ValueType: &datastorepb.Value_StringValue{StringValue: strings.Repeat("a", 100)}},
+				}
+			}
+			out.Found = append(out.Found, &datastorepb.EntityResult{Entity: e})
+		}
+		return nil
+	}
+
+	m := &mock{values: [][]byte{nil, nil}}
+	req := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{newKey("1"), newKey("2")}}
+	out := &datastorepb.LookupResponse{}
+	if err := UnaryClientInterceptor(m, WithMaxValueSize(64))(context.Background(), "/google.datastore.v1.Datastore/Lookup", req, out, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.GetFound()) != 2 {
+		t.Errorf("found %d entities, want 2", len(out.GetFound()))
+	}
+	if want := []string{"1"}; !reflect.DeepEqual(m.setKeys, want) {
+		t.Errorf("called cacher.SetMulti() with keys = %v, want %v", m.setKeys, want)
+	}
+
+	rows, err := view.RetrieveData(SkipsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Data.(*view.SumData).Value != 1 {
+		t.Errorf("%s = %v, want 1", SkipsView.Name, rows)
+	}
+}
+
+func TestBackendName(t *testing.T) {
+	tests := []struct {
+		name   string
+		cacher Cacher
+		want   string
+	}{
+		{
+			name:   "Cacher",
+			cacher: &mock{},
+			want:   "*cache.mock",
+		},
+		{
+			name:   "Leaser",
+			cacher: ForwardLeases(&leaseMock{}, &leaseMock{}),
+			want:   "*cache.leaseMock",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := backendName(tt.cacher); got != tt.want {
+				t.Errorf("backendName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	if err := view.Register(DefaultViews...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(DefaultViews...)
+
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		switch out := reply.(type) {
+		case *datastorepb.LookupResponse:
+			for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+				out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+			}
+		}
+		return nil
+	}
+
+	cached, _ := marshalResult(&datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: newKey("1")}}, false)
+	m := &mock{values: [][]byte{cached, nil, nil}, err: errors.New("delete error")}
+	interceptor := UnaryClientInterceptor(m, WithBackendName("test"))
+	lookup := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{newKey("1"), newKey("2"), newKey("3")}}
+	if err := interceptor(context.Background(), "/google.datastore.v1.Datastore/Lookup", lookup, &datastorepb.LookupResponse{}, nil, invoker); err != nil {
+		t.Fatal(err)
+	}
+	commit := &datastorepb.CommitRequest{Mutations: []*datastorepb.Mutation{
+		{Operation: &datastorepb.Mutation_Delete{Delete: newKey("1")}},
+	}}
+	if err := interceptor(context.Background(), "/google.datastore.v1.Datastore/Commit", commit, &datastorepb.CommitResponse{}, nil, invoker); err == nil {
+		t.Fatal("commit succeeded, want the error of the deletion")
+	}
+
+	// The namespace tag is omitted for the default namespace.
+	wantTags := []tag.Tag{{Key: KeyBackend, Value: "test"}, {Key: KeyKind, Value: "k"}}
+	for _, tt := range []struct {
+		view *view.View
+		want float64
+	}{
+		{view: LookupKeysView, want: 3},
+		{view: HitsView, want: 1},
+		{view: MissesView, want: 2},
+		{view: FillsView, want: 2},
+		{view: FillBytesView, want: float64(len(m.setValues[0]) + len(m.setValues[1]))},
+		{view: InvalidationsView, want: 1},
+		{view: InvalidationErrorsView, want: 1},
+	} {
+		rows, err := view.RetrieveData(tt.view.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(rows) != 1 {
+			t.Errorf("%s has %d rows, want 1", tt.view.Name, len(rows))
+			continue
+		}
+		if !reflect.DeepEqual(rows[0].Tags, wantTags) {
+			t.Errorf("%s tags = %v, want %v", tt.view.Name, rows[0].Tags, wantTags)
+		}
+		if got := rows[0].Data.(*view.SumData).Value; got != tt.want {
+			t.Errorf("%s = %v, want %v", tt.view.Name, got, tt.want)
+		}
+	}
+}
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func TestTrace(t *testing.T) {
+	r := &spanRecorder{}
+	trace.RegisterExporter(r)
+	defer trace.UnregisterExporter(r)
+
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		out := reply.(*datastorepb.LookupResponse)
+		for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+			out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+		}
+		return nil
+	}
+
+	cached, _ := marshalResult(&datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: newKey("1")}}, false)
+	m := &mock{values: [][]byte{cached, nil}}
+	req := &datastorepb.LookupRequest{Keys: []*datastorepb.Key{newKey("1"), newKey("2")}}
+	ctx, span := trace.StartSpan(context.Background(), "test", trace.WithSampler(trace.AlwaysSample()))
+	err := UnaryClientInterceptor(m)(ctx, "/google.datastore.v1.Datastore/Lookup", req, &datastorepb.LookupResponse{}, nil, invoker)
+	span.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(r.spans))
+	}
+	want := map[string]interface{}{
+		"method":      "/google.datastore.v1.Datastore/Lookup",
+		"keys":        int64(2),
+		"kinds":       "k",
+		"hits":        int64(1),
+		"misses":      int64(1),
+		"uncacheable": int64(0),
+		"rounds":      int64(1),
+		"deferred":    int64(0),
+	}
+	if got := r.spans[0].Attributes; !reflect.DeepEqual(got, want) {
+		t.Errorf("span attributes = %v, want %v", got, want)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		cacher      Cacher
+		method      string
+		wantErr     bool
+		wantHandled []string
+	}{
+		{
+			name:        "get error",
+			cacher:      &errorMock{getErr: errors.New("get error")},
+			method:      "/google.datastore.v1.Datastore/Lookup",
+			wantHandled: []string{"GetMulti: get error"},
+		},
+		{
+			name:        "set error",
+			cacher:      &errorMock{setErr: errors.New("set error")},
+			method:      "/google.datastore.v1.Datastore/Lookup",
+			wantHandled: []string{"SetMulti: set error"},
+		},
+		{
+			name:        "lease error",
+			cacher:      &leaseMock{err: errors.New("lease error")},
+			method:      "/google.datastore.v1.Datastore/Lookup",
+			wantHandled: []string{"LeaseMulti: lease error"},
+		},
+		{
+			name:        "delete error",
+			cacher:      &errorMock{mock: mock{err: errors.New("delete error")}},
+			method:      "/google.datastore.v1.Datastore/Commit",
+			wantErr:     true,
+			wantHandled: []string{"DeleteMulti: delete error"},
+		},
+		{
+			name:   "cacher without errors",
+			cacher: &mock{},
+			method: "/google.datastore.v1.Datastore/Lookup",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				if out, ok := reply.(*datastorepb.LookupResponse); ok {
+					for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+						out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}})
+					}
+				}
+				return nil
+			}
+
+			var handled []string
+			handler := func(ctx context.Context, method string, err error) {
+				handled = append(handled, method+": "+err.Error())
+			}
+			var req, reply interface{}
+			switch tt.method {
+			case "/google.datastore.v1.Datastore/Lookup":
+				req = &datastorepb.LookupRequest{Keys: []*datastorepb.Key{newKey("1")}}
+				reply = &datastorepb.LookupResponse{}
+			case "/google.datastore.v1.Datastore/Commit":
+				req = &datastorepb.CommitRequest{Mutations: []*datastorepb.Mutation{
+					{Operation: &datastorepb.Mutation_Delete{Delete: newKey("1")}},
+				}}
+				reply = &datastorepb.CommitResponse{}
+			}
+			err := UnaryClientInterceptor(tt.cacher, WithErrorHandler(handler))(context.Background(), tt.method, req, reply, nil, invoker)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(handled, tt.wantHandled) {
+				t.Errorf("handled errors = %v, want %v", handled, tt.wantHandled)
+			}
+			if out, ok := reply.(*datastorepb.LookupResponse); ok && len(out.GetFound()) != 1 {
+				t.Errorf("found %d entities, want 1", len(out.GetFound()))
+			}
+		})
+	}
+}
+
 func TestPut(t *testing.T) {
 	defer resetEmulator()
 
@@ -430,6 +1382,15 @@ func TestMutate(t *testing.T) {
 			args: []*datastore.Mutation{
 				datastore.NewInsert(datastore.NameKey("TestMutate/insert", "insert", nil), &entity{}),
 			},
+			wantDel: []*datastore.Key{
+				datastore.NameKey("TestMutate/insert", "insert", nil),
+			},
+		},
+		{
+			name: "insert incomplete key",
+			args: []*datastore.Mutation{
+				datastore.NewInsert(datastore.IncompleteKey("TestMutate/insert_incomplete_key", nil), &entity{}),
+			},
 		},
 		{
 			name: "update",
@@ -473,6 +1434,7 @@ func TestMutate(t *testing.T) {
 				datastore.NewDelete(datastore.NameKey("TestMutate/all", "delete", nil)),
 			},
 			wantDel: []*datastore.Key{
+				datastore.NameKey("TestMutate/all", "insert", nil),
 				datastore.NameKey("TestMutate/all", "update", nil),
 				datastore.NameKey("TestMutate/all", "upsert", nil),
 				datastore.NameKey("TestMutate/all", "delete", nil),
@@ -498,6 +1460,163 @@ func TestMutate(t *testing.T) {
 	}
 }
 
+func TestCommitWithLock(t *testing.T) {
+	errCommit := errors.New("commit error")
+	errLock := errors.New("lock error")
+
+	tests := []struct {
+		name          string
+		lockErr       error
+		delErr        error
+		commitErr     error
+		wantErr       error
+		wantCommitted bool
+		wantDel       bool
+	}{
+		{
+			name:          "success",
+			wantCommitted: true,
+			wantDel:       true,
+		},
+		{
+			name:          "delete error",
+			delErr:        errDelCache,
+			wantCommitted: true,
+			wantDel:       true,
+		},
+		{
+			name:    "lock error",
+			lockErr: errLock,
+			wantErr: errLock,
+		},
+		{
+			name:          "commit error",
+			commitErr:     errCommit,
+			wantErr:       errCommit,
+			wantCommitted: true,
+			wantDel:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &lockMock{leaseMock: leaseMock{mock: mock{err: tt.delErr}}, err: tt.lockErr}
+			committed := false
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				if len(m.locked) == 0 {
+					t.Error("Commit is called before locking")
+				}
+				committed = true
+				return tt.commitErr
+			}
+
+			req := &datastorepb.CommitRequest{
+				Mutations: []*datastorepb.Mutation{
+					{Operation: &datastorepb.Mutation_Delete{Delete: newKey("1")}},
+				},
+			}
+			err := UnaryClientInterceptor(m, WithCommitLock(1*time.Second))(context.Background(), "/google.datastore.v1.Datastore/Commit", req, &datastorepb.CommitResponse{}, nil, invoker)
+			if err != tt.wantErr {
+				t.Fatalf("Commit error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if committed != tt.wantCommitted {
+				t.Errorf("called Commit is %t, want %t", committed, tt.wantCommitted)
+			}
+			if isDel := len(m.delKeys) > 0; isDel != tt.wantDel {
+				t.Errorf("called cacher.DeleteMulti() is %t, want %t", isDel, tt.wantDel)
+			}
+			if m.expiration != 1*time.Second {
+				t.Errorf("called cacher.LockMulti() with expiration %v, want %v", m.expiration, 1*time.Second)
+			}
+		})
+	}
+}
+
+func TestCommitWithWriteThrough(t *testing.T) {
+	incomplete := &datastorepb.Key{Path: []*datastorepb.Key_PathElement{{Kind: "k"}}}
+	allocated := &datastorepb.Key{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Name{Name: "allocated"}}}}
+
+	tests := []struct {
+		name         string
+		mockErr      error
+		mutations    []*datastorepb.Mutation
+		results      []*datastorepb.MutationResult
+		wantErr      error
+		wantSet      []string
+		wantVersions []int64
+	}{
+		{
+			name: "all",
+			mutations: []*datastorepb.Mutation{
+				{Operation: &datastorepb.Mutation_Insert{Insert: &datastorepb.Entity{Key: newKey("insert")}}},
+				{Operation: &datastorepb.Mutation_Update{Update: &datastorepb.Entity{Key: newKey("update")}}},
+				{Operation: &datastorepb.Mutation_Upsert{Upsert: &datastorepb.Entity{Key: newKey("upsert")}}},
+				{Operation: &datastorepb.Mutation_Delete{Delete: newKey("delete")}},
+			},
+			results: []*datastorepb.MutationResult{
+				{Version: 1},
+				{Version: 2},
+				{Version: 3},
+				{Version: 4},
+			},
+			wantSet:      []string{"insert", "update", "upsert"},
+			wantVersions: []int64{1, 2, 3},
+		},
+		{
+			name: "incomplete key",
+			mutations: []*datastorepb.Mutation{
+				{Operation: &datastorepb.Mutation_Insert{Insert: &datastorepb.Entity{Key: incomplete}}},
+				{Operation: &datastorepb.Mutation_Insert{Insert: &datastorepb.Entity{Key: incomplete}}},
+			},
+			results: []*datastorepb.MutationResult{
+				{Version: 1, Key: allocated},
+				{Version: 2},
+			},
+			wantSet:      []string{"allocated"},
+			wantVersions: []int64{1},
+		},
+		{
+			name:    "delete error",
+			mockErr: errDelCache,
+			mutations: []*datastorepb.Mutation{
+				{Operation: &datastorepb.Mutation_Upsert{Upsert: &datastorepb.Entity{Key: newKey("upsert")}}},
+			},
+			results: []*datastorepb.MutationResult{
+				{Version: 1},
+			},
+			wantErr: errDelCache,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+				reply.(*datastorepb.CommitResponse).MutationResults = tt.results
+				return nil
+			}
+
+			m := &mock{err: tt.mockErr}
+			req := &datastorepb.CommitRequest{Mutations: tt.mutations}
+			err := UnaryClientInterceptor(m, WithWriteThrough())(context.Background(), "/google.datastore.v1.Datastore/Commit", req, &datastorepb.CommitResponse{}, nil, invoker)
+			if err != tt.wantErr {
+				t.Fatalf("Commit error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(m.setKeys, tt.wantSet) {
+				t.Errorf("called cacher.SetMulti() with keys = %v, want %v", m.setKeys, tt.wantSet)
+			}
+			var versions []int64
+			for _, v := range m.setValues {
+				e, missing, err := unmarshalResult(v)
+				if err != nil || missing {
+					t.Fatalf("invalid value %v: missing = %t, err = %v", v, missing, err)
+				}
+				versions = append(versions, e.GetVersion())
+			}
+			if !reflect.DeepEqual(versions, tt.wantVersions) {
+				t.Errorf("saved versions = %v, want %v", versions, tt.wantVersions)
+			}
+		})
+	}
+}
+
 func TestTxGet(t *testing.T) {
 	defer resetEmulator()
 
@@ -857,6 +1976,15 @@ func TestTxMutate(t *testing.T) {
 			args: []*datastore.Mutation{
 				datastore.NewInsert(datastore.NameKey("TestTxMutate/insert", "insert", nil), &entity{}),
 			},
+			wantDel: []*datastore.Key{
+				datastore.NameKey("TestTxMutate/insert", "insert", nil),
+			},
+		},
+		{
+			name: "insert incomplete key",
+			args: []*datastore.Mutation{
+				datastore.NewInsert(datastore.IncompleteKey("TestTxMutate/insert_incomplete_key", nil), &entity{}),
+			},
 		},
 		{
 			name: "update",
@@ -900,6 +2028,7 @@ func TestTxMutate(t *testing.T) {
 				datastore.NewDelete(datastore.NameKey("TestTxMutate/all", "delete", nil)),
 			},
 			wantDel: []*datastore.Key{
+				datastore.NameKey("TestTxMutate/all", "insert", nil),
 				datastore.NameKey("TestTxMutate/all", "update", nil),
 				datastore.NameKey("TestTxMutate/all", "upsert", nil),
 				datastore.NameKey("TestTxMutate/all", "delete", nil),
@@ -1025,11 +2154,14 @@ type mock struct {
 	values [][]byte
 	err    error
 
-	setKeys []string
-	delKeys []*datastore.Key
+	getKeys   []*datastorepb.Key
+	setKeys   []string
+	setValues [][]byte
+	delKeys   []*datastore.Key
 }
 
 func (m *mock) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	m.getKeys = append(m.getKeys, keys...)
 	return m.values
 }
 
@@ -1037,6 +2169,7 @@ func (m *mock) SetMulti(ctx context.Context, keys []*datastorepb.Key, items [][]
 	for _, k := range keys {
 		m.setKeys = append(m.setKeys, k.Path[0].GetName())
 	}
+	m.setValues = append(m.setValues, items...)
 }
 
 func (m *mock) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
@@ -1051,6 +2184,95 @@ func (m *mock) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
 	return m.err
 }
 
+// syncMock is a mock safe for concurrent use.
+type syncMock struct {
+	mu sync.Mutex
+	mock
+}
+
+func (m *syncMock) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mock.GetMulti(ctx, keys)
+}
+
+func (m *syncMock) SetMulti(ctx context.Context, keys []*datastorepb.Key, items [][]byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mock.SetMulti(ctx, keys, items)
+}
+
+func (m *syncMock) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.mock.DeleteMulti(ctx, keys)
+}
+
+type leaseMock struct {
+	mock
+	leases []uint64
+	err    error
+
+	items       map[string]uint64
+	expirations map[string]time.Duration
+}
+
+func (m *leaseMock) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	return m.leases, m.err
+}
+
+func (m *leaseMock) SetItems(ctx context.Context, items []*Item) error {
+	if m.items == nil {
+		m.items = make(map[string]uint64)
+	}
+	if m.expirations == nil {
+		m.expirations = make(map[string]time.Duration)
+	}
+	for _, v := range items {
+		m.items[v.Key.Path[0].GetName()] = v.Lease
+		m.expirations[v.Key.Path[0].GetName()] = v.Expiration
+	}
+	return nil
+}
+
+type lockMock struct {
+	leaseMock
+	err error
+
+	locked     []*datastorepb.Key
+	expiration time.Duration
+}
+
+func (m *lockMock) LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error {
+	m.locked = append(m.locked, keys...)
+	m.expiration = expiration
+	return m.err
+}
+
+type errorMock struct {
+	mock
+	getErr error
+	setErr error
+}
+
+func (m *errorMock) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	if m.getErr != nil {
+		return nil, m.getErr
+	}
+	return m.GetMulti(ctx, keys), nil
+}
+
+func (m *errorMock) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	m.SetMulti(ctx, keys, values)
+	return m.setErr
+}
+
+func newKey(name string) *datastorepb.Key {
+	return &datastorepb.Key{
+		Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Name{Name: name}}},
+	}
+}
+
 func marshalCache(kind, name string, data string) []byte {
 	b, _ := proto.Marshal(&datastorepb.EntityResult{
 		Entity: &datastorepb.Entity{
@@ -1068,6 +2290,20 @@ func marshalCache(kind, name string, data string) []byte {
 	return b
 }
 
+func marshalTombstone(kind, name string) []byte {
+	b, _ := marshalResult(&datastorepb.EntityResult{
+		Entity: &datastorepb.Entity{
+			Key: &datastorepb.Key{
+				PartitionId: &datastorepb.PartitionId{ProjectId: "test"},
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: kind, IdType: &datastorepb.Key_PathElement_Name{Name: name}},
+				},
+			},
+		},
+	}, true)
+	return b
+}
+
 func putEntities(t *testing.T, m map[string]entity) {
 	t.Helper()
 
@@ -0,0 +1,93 @@
+/*
+Package cacheitem provides the encoding of leases, locks and versioned values
+shared by the cache backends that save them as plain values, such as Redis and
+memcache.
+
+A lease is encoded as LeasePrefix followed by the lease in decimal. A lock is
+a lease that is never held by anyone. A value with a version is encoded as
+VersionPrefix followed by the version in 20 digits and the value, so that the
+versions can be compared as strings.
+
+	\xffL<lease>
+	\xffV<version><value>
+
+Neither prefix is the prefix of values saved by the cache package.
+*/
+package cacheitem
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// LeaseExpiration is the expiration of leases acquired by LeaseMulti.
+	LeaseExpiration = 30 * time.Second
+
+	// LeasePrefix is the prefix of the value of a lease or a lock.
+	LeasePrefix = "\xffL"
+
+	// VersionPrefix is the prefix of the value saved with a version.
+	VersionPrefix = "\xffV"
+
+	versionLen = len(VersionPrefix) + 20
+)
+
+// NewLease returns a random lease that is not 0.
+func NewLease() (uint64, error) {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			return 0, err
+		}
+		if l := binary.BigEndian.Uint64(b[:]); l != 0 {
+			return l, nil
+		}
+	}
+}
+
+// Lease returns the value of the lease.
+func Lease(lease uint64) []byte {
+	return []byte(LeasePrefix + strconv.FormatUint(lease, 10))
+}
+
+// IsLease reports whether the value is a lease or a lock.
+func IsLease(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(LeasePrefix))
+}
+
+// FormatVersion returns the version in 20 digits.
+func FormatVersion(version int64) string {
+	return fmt.Sprintf("%020d", version)
+}
+
+// Versioned returns the value with the version.
+func Versioned(version int64, value []byte) []byte {
+	return append([]byte(VersionPrefix+FormatVersion(version)), value...)
+}
+
+// Version returns the version of the value, or 0 if the value does not have a
+// version.
+func Version(value []byte) int64 {
+	if !bytes.HasPrefix(value, []byte(VersionPrefix)) || len(value) < versionLen {
+		return 0
+	}
+	v, _ := strconv.ParseInt(string(value[len(VersionPrefix):versionLen]), 10, 64)
+	return v
+}
+
+// Value returns the value without the version, or nil if the value is a lease
+// or a lock.
+func Value(value []byte) []byte {
+	switch {
+	case IsLease(value):
+		return nil
+	case bytes.HasPrefix(value, []byte(VersionPrefix)) && len(value) >= versionLen:
+		return value[versionLen:]
+	}
+	return value
+}
@@ -0,0 +1,100 @@
+package cacheitem
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVersioned(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int64
+		value   []byte
+		want    []byte
+	}{
+		{
+			name:    "version",
+			version: 1,
+			value:   []byte{'a'},
+			want:    []byte("\xffV00000000000000000001a"),
+		},
+		{
+			name:    "max version",
+			version: 1<<63 - 1,
+			value:   []byte{'a'},
+			want:    []byte("\xffV09223372036854775807a"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Versioned(tt.version, tt.value)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Versioned() = %q, want %q", got, tt.want)
+			}
+			if v := Version(got); v != tt.version {
+				t.Errorf("Version() = %v, want %v", v, tt.version)
+			}
+			if v := Value(got); !reflect.DeepEqual(v, tt.value) {
+				t.Errorf("Value() = %q, want %q", v, tt.value)
+			}
+		})
+	}
+}
+
+func TestValue(t *testing.T) {
+	tests := []struct {
+		name        string
+		value       []byte
+		want        []byte
+		wantVersion int64
+		wantLease   bool
+	}{
+		{
+			name:  "value",
+			value: []byte{'a'},
+			want:  []byte{'a'},
+		},
+		{
+			name:      "lease",
+			value:     Lease(1),
+			wantLease: true,
+		},
+		{
+			name:        "version",
+			value:       Versioned(2, []byte{'a'}),
+			want:        []byte{'a'},
+			wantVersion: 2,
+		},
+		{
+			name:  "short version",
+			value: []byte("\xffV1a"),
+			want:  []byte("\xffV1a"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Value(tt.value); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Value() = %q, want %q", got, tt.want)
+			}
+			if got := Version(tt.value); got != tt.wantVersion {
+				t.Errorf("Version() = %v, want %v", got, tt.wantVersion)
+			}
+			if got := IsLease(tt.value); got != tt.wantLease {
+				t.Errorf("IsLease() = %v, want %v", got, tt.wantLease)
+			}
+		})
+	}
+}
+
+func TestNewLease(t *testing.T) {
+	l, err := NewLease()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l == 0 {
+		t.Error("NewLease() = 0")
+	}
+	if got := Lease(l); !IsLease(got) {
+		t.Errorf("IsLease(%q) = false", got)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Package cachekey provides the encoding of Cloud Datastore keys to cache keys
+shared by the cache backends.
+
+An encoded key consists of the version of the encoding, the project ID, the
+namespace and the path of the key separated by "/". Each element is escaped
+so that the encoding is unambiguous and can be decoded.
+	v1/<project>/<namespace>/<kind>/<id>[/<kind>/<id>...]
+
+The id is "i" followed by the integer ID, "s" followed by the escaped name, or
+"n" for an incomplete key. For example, the key Kind(1) in the default
+namespace of the project "p" is encoded as "v1/p//Kind/i1".
+
+If the key is longer than the limit given by WithMaxLength, it is hashed to a
+fixed length form that can't be decoded.
+	v1h/<hex encoded SHA-256 of the unhashed form>
+*/
+package cachekey
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+const (
+	// Version is the version of the encoding.
+	Version = "v1"
+
+	hashedVersion = Version + "h"
+)
+
+var (
+	// ErrInvalidKey is returned by Decode when the key is not encoded by the
+	// Encoder.
+	ErrInvalidKey = errors.New("cachekey: invalid key")
+
+	// ErrHashed is returned by Decode when the key is hashed.
+	ErrHashed = errors.New("cachekey: hashed key")
+)
+
+// Encoder encodes Cloud Datastore keys to cache keys.
+type Encoder struct {
+	prefix    string
+	maxLength int
+}
+
+// Option configures the Encoder returned by NewEncoder.
+type Option func(*Encoder)
+
+// WithPrefix returns an Option that prepends the prefix to the encoded keys,
+// e.g. to share a cache server with other applications.
+func WithPrefix(prefix string) Option {
+	return func(e *Encoder) {
+		e.prefix = prefix
+	}
+}
+
+// WithMaxLength returns an Option that hashes the encoded keys longer than n
+// bytes including the prefix. The hashed keys are 68 bytes long excluding the
+// prefix. If n is 0, the keys are not hashed.
+func WithMaxLength(n int) Option {
+	return func(e *Encoder) {
+		e.maxLength = n
+	}
+}
+
+// NewEncoder returns a new Encoder with the given options.
+func NewEncoder(opts ...Option) *Encoder {
+	e := &Encoder{}
+	for _, opt := range opts {
+		opt(e)
+	}
+	return e
+}
+
+var defaultEncoder = NewEncoder()
+
+// Encode encodes the key without a prefix and hashing.
+func Encode(key *datastorepb.Key) string {
+	return defaultEncoder.Encode(key)
+}
+
+// Decode decodes the key encoded by Encode.
+func Decode(s string) (*datastorepb.Key, error) {
+	return defaultEncoder.Decode(s)
+}
+
+// Encode encodes the key.
+func (e *Encoder) Encode(key *datastorepb.Key) string {
+	var b strings.Builder
+
+	b.WriteString(e.prefix)
+	b.WriteString(Version)
+	b.WriteByte('/')
+	b.WriteString(url.PathEscape(key.GetPartitionId().GetProjectId()))
+	b.WriteByte('/')
+	b.WriteString(url.PathEscape(key.GetPartitionId().GetNamespaceId()))
+	for _, p := range key.GetPath() {
+		b.WriteByte('/')
+		b.WriteString(url.PathEscape(p.GetKind()))
+		b.WriteByte('/')
+		switch id := p.GetIdType().(type) {
+		case *datastorepb.Key_PathElement_Id:
+			b.WriteByte('i')
+			b.WriteString(strconv.FormatInt(id.Id, 10))
+		case *datastorepb.Key_PathElement_Name:
+			b.WriteByte('s')
+			b.WriteString(url.PathEscape(id.Name))
+		default:
+			b.WriteByte('n')
+		}
+	}
+
+	s := b.String()
+	if e.maxLength > 0 && len(s) > e.maxLength {
+		sum := sha256.Sum256([]byte(s[len(e.prefix):]))
+		s = e.prefix + hashedVersion + "/" + hex.EncodeToString(sum[:])
+	}
+	return s
+}
+
+// Decode decodes the key encoded by the Encoder. It returns ErrHashed if the
+// key is hashed.
+func (e *Encoder) Decode(s string) (*datastorepb.Key, error) {
+	if !strings.HasPrefix(s, e.prefix) {
+		return nil, ErrInvalidKey
+	}
+	s = s[len(e.prefix):]
+	if strings.HasPrefix(s, hashedVersion+"/") {
+		return nil, ErrHashed
+	}
+
+	elems := strings.Split(s, "/")
+	if len(elems) < 5 || len(elems)%2 == 0 || elems[0] != Version {
+		return nil, ErrInvalidKey
+	}
+
+	project, err := url.PathUnescape(elems[1])
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	namespace, err := url.PathUnescape(elems[2])
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	key := &datastorepb.Key{}
+	if project != "" || namespace != "" {
+		key.PartitionId = &datastorepb.PartitionId{ProjectId: project, NamespaceId: namespace}
+	}
+
+	for i := 3; i < len(elems); i += 2 {
+		kind, err := url.PathUnescape(elems[i])
+		if err != nil {
+			return nil, ErrInvalidKey
+		}
+		p := &datastorepb.Key_PathElement{Kind: kind}
+
+		id := elems[i+1]
+		switch {
+		case strings.HasPrefix(id, "i"):
+			v, err := strconv.ParseInt(id[1:], 10, 64)
+			if err != nil {
+				return nil, ErrInvalidKey
+			}
+			p.IdType = &datastorepb.Key_PathElement_Id{Id: v}
+		case strings.HasPrefix(id, "s"):
+			name, err := url.PathUnescape(id[1:])
+			if err != nil {
+				return nil, ErrInvalidKey
+			}
+			p.IdType = &datastorepb.Key_PathElement_Name{Name: name}
+		case id == "n":
+		default:
+			return nil, ErrInvalidKey
+		}
+		key.Path = append(key.Path, p)
+	}
+	return key, nil
+}
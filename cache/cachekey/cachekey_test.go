@@ -0,0 +1,213 @@
+package cachekey
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func TestEncoder_Encode(t *testing.T) {
+	type args struct {
+		key *datastorepb.Key
+	}
+	tests := []struct {
+		name string
+		opts []Option
+		args args
+		want string
+	}{
+		{
+			name: "id",
+			args: args{key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+				},
+			}},
+			want: "v1///kind/i1",
+		},
+		{
+			name: "name",
+			args: args{key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Name{Name: "a/b c"}},
+				},
+			}},
+			want: "v1///kind/sa%2Fb%20c",
+		},
+		{
+			name: "partition",
+			args: args{key: &datastorepb.Key{
+				PartitionId: &datastorepb.PartitionId{ProjectId: "p", NamespaceId: "ns"},
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "parent", IdType: &datastorepb.Key_PathElement_Name{Name: "name"}},
+					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+				},
+			}},
+			want: "v1/p/ns/parent/sname/kind/i1",
+		},
+		{
+			name: "incomplete",
+			args: args{key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "kind"},
+				},
+			}},
+			want: "v1///kind/n",
+		},
+		{
+			name: "prefix",
+			opts: []Option{WithPrefix("app:")},
+			args: args{key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+				},
+			}},
+			want: "app:v1///kind/i1",
+		},
+		{
+			name: "not hashed",
+			opts: []Option{WithMaxLength(12)},
+			args: args{key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+				},
+			}},
+			want: "v1///kind/i1",
+		},
+		{
+			name: "hashed",
+			opts: []Option{WithPrefix("app:"), WithMaxLength(12)},
+			args: args{key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+				},
+			}},
+			// SHA-256 of "v1///kind/i1".
+			want: "app:v1h/1409246fb9e41c0ad74e4d12c7c400121a4808244b6be8938ed6f1faf15c56f3",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewEncoder(tt.opts...).Encode(tt.args.key); got != tt.want {
+				t.Errorf("Encoder.Encode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncoder_Decode(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		key     *datastorepb.Key
+		wantErr error
+	}{
+		{
+			name: "id",
+			key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: -1}},
+				},
+			},
+		},
+		{
+			name: "name",
+			key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "k/i/n/d", IdType: &datastorepb.Key_PathElement_Name{Name: "%2F/\x00"}},
+				},
+			},
+		},
+		{
+			name: "partition",
+			key: &datastorepb.Key{
+				PartitionId: &datastorepb.PartitionId{ProjectId: "p", NamespaceId: "ns"},
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "parent", IdType: &datastorepb.Key_PathElement_Name{Name: ""}},
+					{Kind: "kind"},
+				},
+			},
+		},
+		{
+			name: "prefix",
+			opts: []Option{WithPrefix("app:")},
+			key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+				},
+			},
+		},
+		{
+			name: "hashed",
+			opts: []Option{WithMaxLength(1)},
+			key: &datastorepb.Key{
+				Path: []*datastorepb.Key_PathElement{
+					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+				},
+			},
+			wantErr: ErrHashed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := NewEncoder(tt.opts...)
+			got, err := e.Decode(e.Encode(tt.key))
+			if err != tt.wantErr {
+				t.Fatalf("Encoder.Decode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !proto.Equal(got, tt.key) {
+				t.Errorf("Encoder.Decode() = %v, want %v", got, tt.key)
+			}
+		})
+	}
+}
+
+func TestEncoder_DecodeInvalid(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"v1//",
+		"v1///kind",
+		"v2///kind/i1",
+		"v1///kind/x1",
+		"v1///kind/iname",
+		"v1///kind/s%zz",
+		"other:v1///kind/i1",
+	} {
+		if _, err := Decode(s); err != ErrInvalidKey {
+			t.Errorf("Encoder.Decode(%q) error = %v, want %v", s, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestEncode_Unambiguous(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{Path: []*datastorepb.Key_PathElement{{Kind: "A1", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "A", IdType: &datastorepb.Key_PathElement_Id{Id: 12}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "A", IdType: &datastorepb.Key_PathElement_Name{Name: "12"}}}},
+		{
+			PartitionId: &datastorepb.PartitionId{NamespaceId: "[default]"},
+			Path:        []*datastorepb.Key_PathElement{{Kind: "A", IdType: &datastorepb.Key_PathElement_Id{Id: 12}}},
+		},
+		{
+			PartitionId: &datastorepb.PartitionId{ProjectId: "p"},
+			Path:        []*datastorepb.Key_PathElement{{Kind: "A", IdType: &datastorepb.Key_PathElement_Id{Id: 12}}},
+		},
+		{Path: []*datastorepb.Key_PathElement{
+			{Kind: "A", IdType: &datastorepb.Key_PathElement_Name{Name: "x/A"}},
+			{Kind: "A", IdType: &datastorepb.Key_PathElement_Id{Id: 12}},
+		}},
+	}
+	seen := make(map[string]int)
+	for i, k := range keys {
+		s := Encode(k)
+		if j, ok := seen[s]; ok {
+			t.Errorf("Encode() of keys[%d] and keys[%d] = %v", j, i, s)
+		}
+		seen[s] = i
+		if strings.ContainsAny(s, " \x00") {
+			t.Errorf("Encode() = %q contains unsafe characters", s)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+/*
+Package chunk provides a cache.Cacher that saves large values of another
+Cacher as multiple items, for the backends that limit the size of an item, such
+as App Engine memcache and memcached.
+
+A value larger than the chunk size is split into chunks saved with the keys
+derived from its key, and a manifest that has the size and the SHA-256 hash of
+the value is saved with its key. The chunks are saved before the manifest, and
+the value is reassembled only if the chunks match the manifest. Otherwise, the
+value is treated as missing, and the manifest is deleted so that the value is
+filled again.
+
+The chunks are saved with the expiration of the manifest, which is chosen once
+for each value by WithExpiration if the expiration of the Policy is not set,
+so that the chunks do not expire before the manifest. Each save of a
+value uses new chunks so that concurrent saves do not mix their chunks. Old
+chunks are not deleted, and are left to expire or to be evicted by the
+backend. Use an expiration, or a backend that evicts items, with this Cacher.
+*/
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"go.opencensus.io/trace"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// DefaultChunkSize is the default maximum size of a chunk. It is smaller than
+// the 1 MB limit of memcache to leave room for the key and the overhead of
+// the item.
+const DefaultChunkSize = 1000 * 1000
+
+// chunkKind is the kind of the last path element of the keys of chunks. Kinds
+// starting with "__" are reserved by the datastore.
+const chunkKind = "__chunk__"
+
+// The header bytes of the values. Like the header bytes of the compression
+// package, they have the wire type 7 that is invalid in protocol buffers,
+// and they are never the first byte of the values saved by
+// cache.UnaryClientInterceptor.
+const (
+	// manifest is the header byte of a manifest. It is followed by the ID of
+	// the chunks, the size of the value and the number of the chunks in
+	// uvarint, and the SHA-256 hash of the value.
+	manifest = 5<<3 | 7
+
+	// raw is the header byte of a value whose first byte is one of the
+	// header bytes.
+	raw = 6<<3 | 7
+)
+
+// idSize is the size of the ID of the chunks of a value.
+const idSize = 8
+
+var errInvalidManifest = errors.New("chunk: invalid manifest")
+
+// Cache is an implementation of cache.Cacher and cache.ItemSetter that saves
+// large values of another Cacher as chunks.
+type Cache struct {
+	cacher     cache.ErrorCacher
+	setter     cache.ItemSetter
+	chunkSize  int
+	expiration cache.Expiration
+}
+
+// Option configures the Cache returned by NewCache.
+type Option func(*Cache)
+
+// WithChunkSize returns an Option that sets the maximum size of a chunk. The
+// values larger than it are split into chunks. The default is
+// DefaultChunkSize.
+func WithChunkSize(size int) Option {
+	return func(c *Cache) {
+		c.chunkSize = size
+	}
+}
+
+// WithExpiration returns an Option that sets the expiration of the values saved
+// as chunks without the expiration of the Policy. It should be the same as the
+// expiration of the Cacher. One expiration is chosen for each value, and the
+// manifest and the chunks of the value are saved with it, so that the jitter
+// of the Cacher does not expire the chunks before the manifest. It is used
+// only if the Cacher implements cache.ItemSetter. The default is the zero
+// value, which saves them with the expiration of the Cacher.
+func WithExpiration(expiration cache.Expiration) Option {
+	return func(c *Cache) {
+		c.expiration = expiration
+	}
+}
+
+// NewCache returns a new Cache that saves large values of c as chunks. The
+// returned Cacher also implements cache.Leaser and cache.Locker if c
+// implements them. Leases and locks are used only for the manifests.
+func NewCache(c cache.Cacher, opts ...Option) cache.Cacher {
+	ret := &Cache{
+		cacher:    cache.AdaptCacher(c),
+		chunkSize: DefaultChunkSize,
+	}
+	ret.setter, _ = c.(cache.ItemSetter)
+	for _, opt := range opts {
+		opt(ret)
+	}
+	if ret.chunkSize < 1 {
+		ret.chunkSize = 1
+	}
+
+	return cache.ForwardLeases(ret, c)
+}
+
+// chunkKey returns the key of the i-th chunk of the value of the key.
+func chunkKey(key *datastorepb.Key, id []byte, i int) *datastorepb.Key {
+	path := make([]*datastorepb.Key_PathElement, len(key.GetPath()), len(key.GetPath())+1)
+	copy(path, key.GetPath())
+	return &datastorepb.Key{
+		PartitionId: key.GetPartitionId(),
+		Path: append(path, &datastorepb.Key_PathElement{
+			Kind:   chunkKind,
+			IdType: &datastorepb.Key_PathElement_Name{Name: hex.EncodeToString(id) + "/" + strconv.Itoa(i)},
+		}),
+	}
+}
+
+// manifestInfo is the content of a manifest.
+type manifestInfo struct {
+	id     []byte
+	size   int
+	chunks int
+	hash   [sha256.Size]byte
+}
+
+func marshalManifest(m *manifestInfo) []byte {
+	b := make([]byte, 0, 1+idSize+2*binary.MaxVarintLen64+sha256.Size)
+	b = append(b, manifest)
+	b = append(b, m.id...)
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(m.size))]...)
+	b = append(b, buf[:binary.PutUvarint(buf[:], uint64(m.chunks))]...)
+	return append(b, m.hash[:]...)
+}
+
+func unmarshalManifest(b []byte) (*manifestInfo, error) {
+	if len(b) < 1+idSize || b[0] != manifest {
+		return nil, errInvalidManifest
+	}
+	m := &manifestInfo{id: b[1 : 1+idSize]}
+	r := bytes.NewReader(b[1+idSize:])
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errInvalidManifest
+	}
+	chunks, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errInvalidManifest
+	}
+	if r.Len() != sha256.Size || chunks == 0 || chunks > size {
+		return nil, errInvalidManifest
+	}
+	m.size = int(size)
+	m.chunks = int(chunks)
+	r.Read(m.hash[:])
+	return m, nil
+}
+
+// GetMulti returns the values of the given keys. The values saved as chunks
+// are reassembled, and are treated as missing if they are inconsistent. The
+// manifests of the inconsistent values are deleted so that they can be filled
+// again.
+func (c *Cache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	ret, _ := c.GetMultiWithError(ctx, keys)
+	return ret
+}
+
+// GetMultiWithError is the same as GetMulti except that it returns the error
+// of the Cacher.
+func (c *Cache) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/chunk.GetMulti")
+	defer func() { span.End() }()
+
+	return cache.DecodeMulti(ctx, c.cacher, keys, c.assembleMulti)
+}
+
+// assembleMulti is a cache.Decoder that retrieves the chunks of the manifests
+// and reassembles the values.
+func (c *Cache) assembleMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) ([][]byte, []*datastorepb.Key, error) {
+	ret := make([][]byte, len(keys))
+	var manifests []*manifestInfo
+	var indexes []int
+	var chunkKeys []*datastorepb.Key
+	var invalid []*datastorepb.Key
+	for i, v := range values {
+		switch {
+		case len(v) == 0:
+			ret[i] = v
+		case v[0] == raw:
+			ret[i] = v[1:]
+		case v[0] == manifest:
+			m, err := unmarshalManifest(v)
+			if err != nil {
+				invalid = append(invalid, keys[i])
+				continue
+			}
+			manifests = append(manifests, m)
+			indexes = append(indexes, i)
+			for j := 0; j < m.chunks; j++ {
+				chunkKeys = append(chunkKeys, chunkKey(keys[i], m.id, j))
+			}
+		default:
+			ret[i] = v
+		}
+	}
+	if len(chunkKeys) == 0 {
+		return ret, invalid, nil
+	}
+
+	trace.FromContext(ctx).AddAttributes(trace.Int64Attribute("chunks", int64(len(chunkKeys))))
+	chunks, err := c.cacher.GetMultiWithError(ctx, chunkKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, m := range manifests {
+		if len(chunks) < m.chunks {
+			chunks = make([][]byte, m.chunks)
+		}
+		if v, ok := assemble(m, chunks[:m.chunks]); ok {
+			ret[indexes[i]] = v
+		} else {
+			invalid = append(invalid, keys[indexes[i]])
+		}
+		chunks = chunks[m.chunks:]
+	}
+	return ret, invalid, nil
+}
+
+// assemble returns the value of the chunks if they match the manifest.
+func assemble(m *manifestInfo, chunks [][]byte) ([]byte, bool) {
+	if len(chunks) != m.chunks {
+		return nil, false
+	}
+	b := make([]byte, 0, m.size)
+	for _, v := range chunks {
+		if v == nil || len(b)+len(v) > m.size {
+			return nil, false
+		}
+		b = append(b, v...)
+	}
+	if len(b) != m.size || sha256.Sum256(b) != m.hash {
+		return nil, false
+	}
+	return b, true
+}
+
+// SetMulti saves the given values, splitting large values into chunks.
+func (c *Cache) SetMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) {
+	c.SetMultiWithError(ctx, keys, values)
+}
+
+// SetMultiWithError is the same as SetMulti except that it returns the error
+// of the Cacher.
+func (c *Cache) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	items := make([]*cache.Item, len(keys))
+	for i, k := range keys {
+		items[i] = &cache.Item{Key: k, Value: values[i]}
+	}
+	return c.SetItems(ctx, items)
+}
+
+// SetItems saves the given items, splitting large values into chunks. The
+// chunks are saved before the manifests, and the manifests are saved by
+// SetItems of the Cacher if it implements cache.ItemSetter, or by SetMulti.
+func (c *Cache) SetItems(ctx context.Context, items []*cache.Item) error {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/chunk.SetItems")
+	defer func() { span.End() }()
+
+	saved := make([]*cache.Item, len(items))
+	var chunks []*cache.Item
+	for i, v := range items {
+		item := *v
+		saved[i] = &item
+		switch {
+		case len(v.Value) > c.chunkSize:
+			if item.Expiration == 0 && c.setter != nil {
+				item.Expiration = c.expiration.Next()
+			}
+			m, err := c.split(&item, &chunks)
+			if err != nil {
+				return err
+			}
+			item.Value = marshalManifest(m)
+		case len(v.Value) > 0 && (v.Value[0] == manifest || v.Value[0] == raw):
+			item.Value = append([]byte{raw}, v.Value...)
+		}
+	}
+
+	if len(chunks) > 0 {
+		span.AddAttributes(trace.Int64Attribute("chunks", int64(len(chunks))))
+		if err := c.setItems(ctx, chunks); err != nil {
+			return err
+		}
+	}
+	return c.setItems(ctx, saved)
+}
+
+// split appends the chunks of the value of the item to chunks with the
+// expiration of the item, and returns the manifest of them.
+func (c *Cache) split(item *cache.Item, chunks *[]*cache.Item) (*manifestInfo, error) {
+	m := &manifestInfo{
+		id:   make([]byte, idSize),
+		size: len(item.Value),
+		hash: sha256.Sum256(item.Value),
+	}
+	if _, err := rand.Read(m.id); err != nil {
+		return nil, err
+	}
+	for b := item.Value; len(b) > 0; m.chunks++ {
+		n := c.chunkSize
+		if n > len(b) {
+			n = len(b)
+		}
+		*chunks = append(*chunks, &cache.Item{
+			Key:        chunkKey(item.Key, m.id, m.chunks),
+			Value:      b[:n],
+			Expiration: item.Expiration,
+		})
+		b = b[n:]
+	}
+	return m, nil
+}
+
+// setItems saves the items by SetItems of the Cacher if it implements
+// cache.ItemSetter, or by SetMulti.
+func (c *Cache) setItems(ctx context.Context, items []*cache.Item) error {
+	if c.setter != nil {
+		return c.setter.SetItems(ctx, items)
+	}
+	keys := make([]*datastorepb.Key, len(items))
+	values := make([][]byte, len(items))
+	for i, v := range items {
+		keys[i] = v.Key
+		values[i] = v.Value
+	}
+	return c.cacher.SetMultiWithError(ctx, keys, values)
+}
+
+// DeleteMulti deletes the values of the given keys. The chunks are not
+// deleted, but they are no longer used.
+func (c *Cache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	return c.cacher.DeleteMulti(ctx, keys)
+}
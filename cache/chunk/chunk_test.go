@@ -0,0 +1,256 @@
+package chunk
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/memory"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// testKeys returns n keys of child entities in a namespace, whose chunk keys
+// share the ancestors and the partition.
+func testKeys(n int) []*datastorepb.Key {
+	ret := make([]*datastorepb.Key, n)
+	for i := range ret {
+		ret[i] = &datastorepb.Key{
+			PartitionId: &datastorepb.PartitionId{NamespaceId: "ns"},
+			Path: []*datastorepb.Key_PathElement{
+				{Kind: "parent", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+				{Kind: "k", IdType: &datastorepb.Key_PathElement_Name{Name: strconv.Itoa(i)}},
+			},
+		}
+	}
+	return ret
+}
+
+func TestCache_SetMulti(t *testing.T) {
+	tests := []struct {
+		name       string
+		value      []byte
+		wantChunks []string
+		wantSaved  []byte
+	}{
+		{
+			name:      "as large as a chunk",
+			value:     []byte("0123"),
+			wantSaved: []byte("0123"),
+		},
+		{
+			name:       "larger than a chunk",
+			value:      []byte("01234"),
+			wantChunks: []string{"0123", "4"},
+		},
+		{
+			name:       "multiple of the chunk size",
+			value:      []byte("01234567"),
+			wantChunks: []string{"0123", "4567"},
+		},
+		{
+			name:      "starting with the manifest byte",
+			value:     []byte{manifest, 'a'},
+			wantSaved: []byte{raw, manifest, 'a'},
+		},
+		{
+			name:      "starting with the raw byte",
+			value:     []byte{raw},
+			wantSaved: []byte{raw, raw},
+		},
+		{
+			name:      "empty",
+			value:     []byte{},
+			wantSaved: []byte{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := memory.NewCache(cache.Expiration{})
+			c := NewCache(backend, WithChunkSize(4))
+			keys := testKeys(1)
+			c.SetMulti(ctx, keys, [][]byte{tt.value})
+			if got := c.GetMulti(ctx, keys)[0]; !bytes.Equal(got, tt.value) {
+				t.Errorf("Cache.GetMulti() = %q, want %q", got, tt.value)
+			}
+
+			saved := backend.GetMulti(ctx, keys)[0]
+			if tt.wantChunks == nil {
+				if !bytes.Equal(saved, tt.wantSaved) {
+					t.Errorf("saved value = %v, want %v", saved, tt.wantSaved)
+				}
+				return
+			}
+			m, err := unmarshalManifest(saved)
+			if err != nil {
+				t.Fatalf("saved value = %v, want a manifest: %v", saved, err)
+			}
+			if m.chunks != len(tt.wantChunks) || m.size != len(tt.value) {
+				t.Errorf("manifest = %d chunks of %d bytes, want %d chunks of %d bytes", m.chunks, m.size, len(tt.wantChunks), len(tt.value))
+			}
+			for i, want := range tt.wantChunks {
+				k := chunkKey(keys[0], m.id, i)
+				if k.GetPartitionId().GetNamespaceId() != "ns" || len(k.GetPath()) != 3 || k.GetPath()[1].GetName() != "0" {
+					t.Errorf("chunkKey() = %v, want a child of %v", k, keys[0])
+				}
+				if got := backend.GetMulti(ctx, []*datastorepb.Key{k})[0]; string(got) != want {
+					t.Errorf("chunk %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCache_Invalid(t *testing.T) {
+	keys := testKeys(3)
+	backend := memory.NewCache(cache.Expiration{})
+	c := NewCache(backend, WithChunkSize(4))
+	values := [][]byte{[]byte("0123456789"), []byte("abcdefghij"), []byte("ABCDEFGHIJ")}
+	c.SetMulti(context.Background(), keys, values)
+
+	saved := backend.GetMulti(context.Background(), keys)
+	m0, _ := unmarshalManifest(saved[0])
+	m1, _ := unmarshalManifest(saved[1])
+	// A missing chunk, a modified chunk, and an invalid manifest.
+	backend.DeleteMulti(context.Background(), []*datastorepb.Key{chunkKey(keys[0], m0.id, 1)})
+	backend.SetMulti(context.Background(), []*datastorepb.Key{chunkKey(keys[1], m1.id, 2)}, [][]byte{[]byte("xy")})
+	backend.SetMulti(context.Background(), keys[2:3], [][]byte{saved[2][:5]})
+
+	want := [][]byte{nil, nil, nil}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+
+	// The chunks of the older value are not used.
+	c.SetMulti(context.Background(), keys[:1], [][]byte{[]byte("9876543210")})
+	backend.SetMulti(context.Background(), keys[:1], saved[:1])
+	if got := c.GetMulti(context.Background(), keys[:1]); got[0] != nil {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, [][]byte{nil})
+	}
+}
+
+func TestCache_EvictedChunk(t *testing.T) {
+	ctx := context.Background()
+	keys := testKeys(1)
+	backend := memory.NewCache(cache.Expiration{})
+	c := NewCache(backend, WithChunkSize(4))
+	value := []byte("0123456789")
+	c.SetMulti(ctx, keys[:1], [][]byte{value})
+
+	m, _ := unmarshalManifest(backend.GetMulti(ctx, keys[:1])[0])
+	backend.DeleteMulti(ctx, []*datastorepb.Key{chunkKey(keys[0], m.id, 2)})
+	if got := c.GetMulti(ctx, keys[:1]); got[0] != nil {
+		t.Errorf("Cache.GetMulti() = %v, want nil", got)
+	}
+	// The manifest is deleted so that the value is leased and filled again.
+	if got := backend.GetMulti(ctx, keys[:1]); got[0] != nil {
+		t.Errorf("saved value = %v, want the manifest to be deleted", got[0])
+	}
+	leaser := c.(cache.Leaser)
+	leases, err := leaser.LeaseMulti(ctx, keys[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := leaser.SetItems(ctx, []*cache.Item{{Key: keys[0], Value: value, Lease: leases[0]}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(ctx, keys[:1]); !bytes.Equal(got[0], value) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got[0], value)
+	}
+}
+
+func TestCache_LeaseManifest(t *testing.T) {
+	ctx := context.Background()
+	keys := testKeys(3)
+	c := NewCache(memory.NewCache(cache.Expiration{}), WithChunkSize(4))
+	locker, ok := c.(cache.Locker)
+	if !ok {
+		t.Fatal("NewCache() does not implement cache.Locker")
+	}
+	leases, err := locker.LeaseMulti(ctx, keys[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := locker.LockMulti(ctx, keys[1:2], 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Large values are saved only with the leases of the manifest keys.
+	value := []byte("0123456789")
+	if err := locker.SetItems(ctx, []*cache.Item{
+		{Key: keys[0], Value: value, Lease: leases[0]},
+		{Key: keys[1], Value: value},
+		{Key: keys[2], Value: value, Lease: leases[0]},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{value, nil, nil}
+	if got := c.GetMulti(ctx, keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+}
+
+// expirationRecorder is a memory.Cache that records the expirations of the
+// saved items.
+type expirationRecorder struct {
+	*memory.Cache
+	expirations map[string]time.Duration
+}
+
+func (c *expirationRecorder) SetItems(ctx context.Context, items []*cache.Item) error {
+	for _, v := range items {
+		c.expirations[v.Key.String()] = v.Expiration
+	}
+	return c.Cache.SetItems(ctx, items)
+}
+
+func TestCache_Expiration(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiration time.Duration
+		min, max   time.Duration
+	}{
+		{
+			name: "default",
+			min:  1 * time.Minute,
+			max:  1 * time.Hour,
+		},
+		{
+			name:       "policy",
+			expiration: 2 * time.Hour,
+			min:        2 * time.Hour,
+			max:        2 * time.Hour,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := testKeys(1)
+			exp := cache.TTLRange(1*time.Minute, 1*time.Hour)
+			backend := &expirationRecorder{Cache: memory.NewCache(exp), expirations: make(map[string]time.Duration)}
+			c := NewCache(backend, WithChunkSize(4), WithExpiration(exp)).(cache.ItemSetter)
+			if err := c.SetItems(context.Background(), []*cache.Item{
+				{Key: keys[0], Value: bytes.Repeat([]byte{'a'}, 100), Expiration: tt.expiration},
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// The manifest and all chunks expire at the same time.
+			want := backend.expirations[keys[0].String()]
+			if want < tt.min || want > tt.max {
+				t.Errorf("expiration of the manifest = %v, want in [%v, %v]", want, tt.min, tt.max)
+			}
+			if len(backend.expirations) != 26 {
+				t.Errorf("saved %d items, want 26", len(backend.expirations))
+			}
+			for k, v := range backend.expirations {
+				if v != want {
+					t.Errorf("expiration of %s = %v, want %v", k, v, want)
+				}
+			}
+		})
+	}
+}
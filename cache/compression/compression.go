@@ -0,0 +1,249 @@
+/*
+Package compression provides a cache.Cacher that compresses the values of
+another Cacher.
+
+Values larger than the threshold are compressed by gzip, zstd or snappy, and
+saved with a header byte that identifies the codec. Values without the header
+byte are returned as they are, so the Cacher can be used on a cache that has
+uncompressed values saved by cache.UnaryClientInterceptor without it. The
+header bytes are never the first byte of such values, since they have the
+wire type 7 that is invalid in protocol buffers.
+*/
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"go.opencensus.io/trace"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// Codec is a compression algorithm.
+type Codec byte
+
+// The codecs. Their values are the header bytes of the compressed values.
+const (
+	Gzip   Codec = 1<<3 | 7
+	Zstd   Codec = 2<<3 | 7
+	Snappy Codec = 3<<3 | 7
+)
+
+// raw is the header byte of an uncompressed value whose first byte is one of
+// the header bytes.
+const raw = 0<<3 | 7
+
+// DefaultThreshold is the default size of values to be compressed.
+const DefaultThreshold = 1024
+
+var errUnknownCodec = errors.New("compression: unknown codec")
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func (c Codec) encode(b []byte) ([]byte, error) {
+	switch c {
+	case Gzip:
+		var buf bytes.Buffer
+		buf.WriteByte(byte(Gzip))
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(b, []byte{byte(Zstd)}), nil
+	case Snappy:
+		dst := make([]byte, 1+snappy.MaxEncodedLen(len(b)))
+		dst[0] = byte(Snappy)
+		return dst[:1+len(snappy.Encode(dst[1:], b))], nil
+	}
+	return nil, errUnknownCodec
+}
+
+func (c Codec) decode(b []byte) ([]byte, error) {
+	switch c {
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case Zstd:
+		return zstdDecoder.DecodeAll(b, nil)
+	case Snappy:
+		return snappy.Decode(nil, b)
+	}
+	return nil, errUnknownCodec
+}
+
+// Cache is an implementation of cache.Cacher and cache.ItemSetter that
+// compresses the values of another Cacher.
+type Cache struct {
+	cacher    cache.ErrorCacher
+	setter    cache.ItemSetter
+	codec     Codec
+	threshold int
+}
+
+// Option configures the Cache returned by NewCache.
+type Option func(*Cache)
+
+// WithCodec returns an Option that sets the codec to compress values. The
+// default is Gzip. Values compressed by any codec can be read regardless of
+// this option, so the codec can be changed on a live cache.
+func WithCodec(codec Codec) Option {
+	return func(c *Cache) {
+		c.codec = codec
+	}
+}
+
+// WithThreshold returns an Option that compresses only the values larger than
+// or equal to size bytes. The default is DefaultThreshold.
+func WithThreshold(size int) Option {
+	return func(c *Cache) {
+		c.threshold = size
+	}
+}
+
+// NewCache returns a new Cache that compresses the values of c. The returned
+// Cacher also implements cache.Leaser and cache.Locker if c implements them.
+func NewCache(c cache.Cacher, opts ...Option) cache.Cacher {
+	ret := &Cache{
+		cacher:    cache.AdaptCacher(c),
+		codec:     Gzip,
+		threshold: DefaultThreshold,
+	}
+	ret.setter, _ = c.(cache.ItemSetter)
+	for _, opt := range opts {
+		opt(ret)
+	}
+
+	return cache.ForwardLeases(ret, c)
+}
+
+// compress returns the value saved to the Cacher.
+func (c *Cache) compress(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	if len(b) >= c.threshold {
+		if v, err := c.codec.encode(b); err == nil && len(v) < len(b) {
+			return v
+		}
+	}
+	if len(b) > 0 && isHeader(b[0]) {
+		return append([]byte{raw}, b...)
+	}
+	return b
+}
+
+// decompress returns the value saved by compress. A value without a header
+// byte is returned as it is.
+func decompress(b []byte) ([]byte, error) {
+	if len(b) == 0 || !isHeader(b[0]) {
+		return b, nil
+	}
+	if b[0] == raw {
+		return b[1:], nil
+	}
+	return Codec(b[0]).decode(b[1:])
+}
+
+func isHeader(b byte) bool {
+	switch b {
+	case raw, byte(Gzip), byte(Zstd), byte(Snappy):
+		return true
+	}
+	return false
+}
+
+// GetMulti returns the decompressed values of the given keys. Values that
+// cannot be decompressed are treated as missing, and are deleted so that they
+// can be filled again.
+func (c *Cache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	ret, _ := c.GetMultiWithError(ctx, keys)
+	return ret
+}
+
+// GetMultiWithError is the same as GetMulti except that it returns the error
+// of the Cacher.
+func (c *Cache) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/compression.GetMulti")
+	defer func() { span.End() }()
+
+	return cache.DecodeMulti(ctx, c.cacher, keys, decompressMulti)
+}
+
+// decompressMulti is a cache.Decoder that decompresses the values.
+func decompressMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) ([][]byte, []*datastorepb.Key, error) {
+	ret := make([][]byte, len(keys))
+	var invalid []*datastorepb.Key
+	for i, v := range values {
+		if b, err := decompress(v); err == nil {
+			ret[i] = b
+		} else {
+			invalid = append(invalid, keys[i])
+		}
+	}
+	return ret, invalid, nil
+}
+
+// SetMulti compresses the given values and saves them.
+func (c *Cache) SetMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) {
+	c.SetMultiWithError(ctx, keys, values)
+}
+
+// SetMultiWithError is the same as SetMulti except that it returns the error
+// of the Cacher.
+func (c *Cache) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/compression.SetMulti")
+	defer func() { span.End() }()
+
+	vs := make([][]byte, len(values))
+	for i, v := range values {
+		vs[i] = c.compress(v)
+	}
+	return c.cacher.SetMultiWithError(ctx, keys, vs)
+}
+
+// SetItems compresses the values of the given items and saves them by
+// SetItems of the Cacher if it implements cache.ItemSetter, or by SetMulti.
+func (c *Cache) SetItems(ctx context.Context, items []*cache.Item) error {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/compression.SetItems")
+	defer func() { span.End() }()
+
+	if c.setter == nil {
+		keys := make([]*datastorepb.Key, len(items))
+		values := make([][]byte, len(items))
+		for i, v := range items {
+			keys[i] = v.Key
+			values[i] = c.compress(v.Value)
+		}
+		return c.cacher.SetMultiWithError(ctx, keys, values)
+	}
+
+	compressed := make([]*cache.Item, len(items))
+	for i, v := range items {
+		item := *v
+		item.Value = c.compress(v.Value)
+		compressed[i] = &item
+	}
+	return c.setter.SetItems(ctx, compressed)
+}
+
+// DeleteMulti deletes the values of the given keys.
+func (c *Cache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	return c.cacher.DeleteMulti(ctx, keys)
+}
@@ -0,0 +1,209 @@
+package compression
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/memory"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func newKey(id int64) *datastorepb.Key {
+	return &datastorepb.Key{
+		Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: id}}},
+	}
+}
+
+func TestCache_SetMulti(t *testing.T) {
+	compressible := bytes.Repeat([]byte{'a'}, 100)
+	// The bytes 0-255 do not get smaller by any codec.
+	incompressible := make([]byte, 256)
+	for i := range incompressible {
+		incompressible[i] = byte(i)
+	}
+	tests := []struct {
+		name      string
+		codec     Codec
+		threshold int
+		value     []byte
+		want      byte
+	}{
+		{
+			name:      "Gzip",
+			codec:     Gzip,
+			threshold: 16,
+			value:     compressible,
+			want:      byte(Gzip),
+		},
+		{
+			name:      "Zstd",
+			codec:     Zstd,
+			threshold: 16,
+			value:     compressible,
+			want:      byte(Zstd),
+		},
+		{
+			name:      "Snappy",
+			codec:     Snappy,
+			threshold: 16,
+			value:     compressible,
+			want:      byte(Snappy),
+		},
+		{
+			name:      "smaller than the threshold",
+			codec:     Gzip,
+			threshold: DefaultThreshold,
+			value:     compressible,
+			want:      compressible[0],
+		},
+		{
+			name:      "incompressible",
+			codec:     Zstd,
+			threshold: 16,
+			value:     incompressible,
+			want:      incompressible[0],
+		},
+		{
+			name:      "starting with a header byte",
+			codec:     Gzip,
+			threshold: DefaultThreshold,
+			value:     []byte{byte(Snappy), 'a'},
+			want:      raw,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := memory.NewCache(cache.Expiration{})
+			c := NewCache(backend, WithCodec(tt.codec), WithThreshold(tt.threshold))
+			keys := []*datastorepb.Key{newKey(1)}
+			c.SetMulti(ctx, keys, [][]byte{tt.value})
+
+			saved := backend.GetMulti(ctx, keys)[0]
+			if len(saved) == 0 || saved[0] != tt.want {
+				t.Errorf("saved value = %v, want to start with %#x", saved, tt.want)
+			}
+			if tt.want == tt.value[0] && !bytes.Equal(saved, tt.value) {
+				t.Errorf("saved value = %v, want %v", saved, tt.value)
+			}
+			if got := c.GetMulti(ctx, keys)[0]; !bytes.Equal(got, tt.value) {
+				t.Errorf("Cache.GetMulti() = %v, want %v", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestCache_GetMulti(t *testing.T) {
+	tests := []struct {
+		name        string
+		saved       []byte
+		want        []byte
+		wantDeleted bool
+	}{
+		{
+			name:  "uncompressed",
+			saved: []byte{0x0a, 'a'},
+			want:  []byte{0x0a, 'a'},
+		},
+		{
+			name:  "saved without this Cacher",
+			saved: []byte{0x00, 0x0a},
+			want:  []byte{0x00, 0x0a},
+		},
+		{
+			name:  "escaped header byte",
+			saved: []byte{raw, byte(Gzip), 'a'},
+			want:  []byte{byte(Gzip), 'a'},
+		},
+		{
+			name:        "corrupted Gzip",
+			saved:       []byte{byte(Gzip), 'x'},
+			wantDeleted: true,
+		},
+		{
+			name:        "corrupted Zstd",
+			saved:       []byte{byte(Zstd), 'x'},
+			wantDeleted: true,
+		},
+		{
+			name:        "corrupted Snappy",
+			saved:       []byte{byte(Snappy), 0xff},
+			wantDeleted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := memory.NewCache(cache.Expiration{})
+			keys := []*datastorepb.Key{newKey(1), newKey(2)}
+			backend.SetMulti(ctx, keys[:1], [][]byte{tt.saved})
+
+			c := NewCache(backend)
+			if got, want := c.GetMulti(ctx, keys), [][]byte{tt.want, nil}; !reflect.DeepEqual(got, want) {
+				t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+			}
+			if got := backend.GetMulti(ctx, keys[:1])[0]; (got == nil) != tt.wantDeleted {
+				t.Errorf("saved value = %v, want deleted = %v", got, tt.wantDeleted)
+			}
+			// The key of the corrupted value can be leased and filled.
+			leases, err := c.(cache.Leaser).LeaseMulti(ctx, keys[:1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (leases[0] != 0) != tt.wantDeleted {
+				t.Errorf("Cache.LeaseMulti() = %v, want a lease = %v", leases, tt.wantDeleted)
+			}
+		})
+	}
+}
+
+func TestCache_SetItems(t *testing.T) {
+	ctx := context.Background()
+	backend := memory.NewCache(cache.Expiration{})
+	c := NewCache(backend, WithCodec(Snappy), WithThreshold(0))
+	keys := []*datastorepb.Key{newKey(1), newKey(2)}
+
+	leaser, ok := c.(cache.Locker)
+	if !ok {
+		t.Fatal("NewCache() does not implement cache.Locker")
+	}
+	leases, err := leaser.LeaseMulti(ctx, keys[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value := bytes.Repeat([]byte{'a'}, 100)
+	if err := leaser.SetItems(ctx, []*cache.Item{
+		{Key: keys[0], Value: value, Lease: leases[0]},
+		{Key: keys[1], Value: value, Lease: leases[0] + 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{value, nil}
+	if got := c.GetMulti(ctx, keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+	if saved := backend.GetMulti(ctx, keys[:1])[0]; len(saved) == 0 || saved[0] != byte(Snappy) {
+		t.Errorf("saved value = %v, want to be compressed by Snappy", saved)
+	}
+
+	if err := c.DeleteMulti(ctx, keys[:1]); err != nil {
+		t.Fatal(err)
+	}
+	if got := backend.GetMulti(ctx, keys[:1]); got[0] != nil {
+		t.Errorf("saved value = %v, want to be deleted", got[0])
+	}
+}
+
+func TestNewCache(t *testing.T) {
+	c := NewCache(struct{ cache.Cacher }{memory.NewCache(cache.Expiration{})})
+	if _, ok := c.(cache.Leaser); ok {
+		t.Error("NewCache() implements cache.Leaser, want not to implement it for a Cacher")
+	}
+	if _, ok := c.(cache.ItemSetter); !ok {
+		t.Error("NewCache() does not implement cache.ItemSetter")
+	}
+}
@@ -0,0 +1,74 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// control is a set of flags that changes the behavior of the interceptor for
+// a call.
+type control int
+
+const (
+	controlBypass control = 1 << iota
+	controlRefresh
+	controlReadOnly
+	controlSkipInvalidation
+)
+
+type controlKey struct{}
+
+func withControl(ctx context.Context, c control) context.Context {
+	return context.WithValue(ctx, controlKey{}, controlFromContext(ctx)|c)
+}
+
+func controlFromContext(ctx context.Context) control {
+	c, _ := ctx.Value(controlKey{}).(control)
+	return c
+}
+
+// detachedContext is a context that has the values of the parent context but
+// is neither canceled nor has a deadline with it, such as the trace span and
+// the App Engine request used by the Cacher.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// Bypass returns a copy of ctx that makes Lookup neither use nor save the
+// cache, and makes Commit not save the cache by WithWriteThrough. The cache is
+// still deleted by Commit.
+func Bypass(ctx context.Context) context.Context {
+	return withControl(ctx, controlBypass)
+}
+
+// Refresh returns a copy of ctx that makes Lookup retrieve all entities from
+// the datastore without using the cache, and save them. The cached data is
+// overwritten unless it has a newer version. If the Cacher implements Leaser,
+// the entities are saved with leases or replace the cached values, so that
+// they do not overwrite locks or the deletions by concurrent commits.
+func Refresh(ctx context.Context) context.Context {
+	return withControl(ctx, controlRefresh)
+}
+
+// ReadOnly returns a copy of ctx that makes Lookup use the cache but not save
+// the entities retrieved from the datastore, and makes Commit not save the
+// cache by WithWriteThrough. The cache is still deleted by Commit.
+func ReadOnly(ctx context.Context) context.Context {
+	return withControl(ctx, controlReadOnly)
+}
+
+// SkipInvalidation returns a copy of ctx that makes Commit neither lock,
+// delete nor save the cache. It is intended for tools that modify entities
+// that are not cached, such as data migrations. Using it for cached entities
+// makes the cache inconsistent with the datastore.
+func SkipInvalidation(ctx context.Context) context.Context {
+	return withControl(ctx, controlSkipInvalidation)
+}
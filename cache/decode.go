@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"context"
+
+	"go.opencensus.io/trace"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// Decoder decodes the values of the keys retrieved from a Cacher, where
+// values has the same length as keys and a nil value is missing. It returns
+// the decoded values in the same order, and the keys of the values that cannot
+// be decoded, such as corrupted values and values saved in another format.
+type Decoder func(ctx context.Context, keys []*datastorepb.Key, values [][]byte) ([][]byte, []*datastorepb.Key, error)
+
+// DecodeMulti returns the values of the keys retrieved from c and decoded by
+// decode. It is for a Cacher that wraps c and encodes the values saved to it.
+//
+// The values that cannot be decoded are treated as missing, and are deleted
+// from c. Otherwise a Leaser never leases their keys, and they are never
+// filled again. The error of the deletion is ignored since they are deleted
+// again by the next call.
+//
+// The returned values are not nil even if the error is not nil, so that they
+// can be returned by Cacher.GetMulti.
+func DecodeMulti(ctx context.Context, c ErrorCacher, keys []*datastorepb.Key, decode Decoder) ([][]byte, error) {
+	values, err := c.GetMultiWithError(ctx, keys)
+	if err != nil {
+		return make([][]byte, len(keys)), err
+	}
+	if len(values) != len(keys) {
+		vs := make([][]byte, len(keys))
+		copy(vs, values)
+		values = vs
+	}
+	ret, invalid, err := decode(ctx, keys, values)
+	if err != nil {
+		return make([][]byte, len(keys)), err
+	}
+	trace.FromContext(ctx).AddAttributes(trace.Int64Attribute("invalid", int64(len(invalid))))
+	if len(invalid) > 0 {
+		c.DeleteMulti(ctx, invalid)
+	}
+	return ret, nil
+}
@@ -0,0 +1,62 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/memory"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// trimDecoder decodes the values with the prefix "v:".
+func trimDecoder(ctx context.Context, keys []*datastorepb.Key, values [][]byte) ([][]byte, []*datastorepb.Key, error) {
+	ret := make([][]byte, len(keys))
+	var invalid []*datastorepb.Key
+	for i, v := range values {
+		switch {
+		case v == nil:
+		case bytes.HasPrefix(v, []byte("v:")):
+			ret[i] = v[2:]
+		default:
+			invalid = append(invalid, keys[i])
+		}
+	}
+	return ret, invalid, nil
+}
+
+func TestDecodeMulti(t *testing.T) {
+	ctx := context.Background()
+	keys := make([]*datastorepb.Key, 3)
+	for i := range keys {
+		keys[i] = &datastorepb.Key{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: int64(i + 1)}}},
+		}
+	}
+	c := memory.NewCache(cache.Expiration{})
+	c.SetMulti(ctx, keys[:2], [][]byte{[]byte("v:a"), []byte("b")})
+
+	got, err := cache.DecodeMulti(ctx, cache.AdaptCacher(c), keys, trimDecoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{[]byte("a"), nil, nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeMulti() = %q, want %q", got, want)
+	}
+	// The value that cannot be decoded is deleted.
+	if got, want := c.GetMulti(ctx, keys[:2]), [][]byte{[]byte("v:a"), nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %q, want %q", got, want)
+	}
+
+	errGet := errors.New("get")
+	got, err = cache.DecodeMulti(ctx, &errorCacher{itemCacher{c}, errGet}, keys, trimDecoder)
+	if err != errGet {
+		t.Errorf("DecodeMulti() error = %v, want %v", err, errGet)
+	}
+	if want := make([][]byte, len(keys)); !reflect.DeepEqual(got, want) {
+		t.Errorf("DecodeMulti() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+Package encryption provides a cache.Cacher that encrypts the values of another
+Cacher by AES-GCM.
+
+The encoded Datastore key is authenticated as the associated data, so a value
+cannot be read as the value of another key. Each value has the ID of the
+encryption key, and values encrypted by the keys set by WithDecryptionKeys can
+be read after the key is rotated. Values that cannot be decrypted, such as the
+values of unknown keys and the values saved without encryption, are treated as
+missing and are deleted, so that they are filled again with the current key.
+
+Since a process deletes the values encrypted by the keys unknown to it, rotate
+the key in two phases while processes with different keys share the cache.
+First, deploy the new key by WithDecryptionKeys to all processes. Then make it
+the primary key, keeping the old key by WithDecryptionKeys until all processes
+use the new key. Otherwise the processes delete the values of each other.
+
+To compress values, compress them before encryption by compression.NewCache
+over the Cacher of this package.
+*/
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cachekey"
+	"go.opencensus.io/trace"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// header is the first byte of an encrypted value. It has the wire type 7 that
+// is invalid in protocol buffers, and differs from the header bytes of the
+// compression and chunk packages, so that it is never the first byte of the
+// values saved without encryption, including the soft-expiring values of
+// cache.WithStaleWhileRevalidate.
+const header = 4<<3 | 7
+
+// headerSize is the size of the header byte and the key ID.
+const headerSize = 1 + 4
+
+var errInvalidValue = errors.New("encryption: invalid value")
+
+// Key is an AES key to encrypt values. Secret must be 16, 24 or 32 bytes to
+// select AES-128, AES-192 or AES-256.
+type Key struct {
+	// ID identifies the key used to encrypt a value. It must be unique
+	// among the keys of a Cache.
+	ID uint32
+
+	Secret []byte
+}
+
+// Cache is an implementation of cache.Cacher and cache.ItemSetter that
+// encrypts the values of another Cacher.
+type Cache struct {
+	cacher  cache.ErrorCacher
+	setter  cache.ItemSetter
+	primary uint32
+	aeads   map[uint32]cipher.AEAD
+	oldKeys []Key
+}
+
+// Option configures the Cache returned by NewCache.
+type Option func(*Cache)
+
+// WithDecryptionKeys returns an Option that decrypts the values encrypted by
+// the keys, such as the keys used before a rotation and the key that becomes
+// the primary key in the next rotation. They are not used to encrypt values.
+func WithDecryptionKeys(keys ...Key) Option {
+	return func(c *Cache) {
+		c.oldKeys = append(c.oldKeys, keys...)
+	}
+}
+
+// NewCache returns a new Cache that encrypts the values of c by key. The
+// returned Cacher also implements cache.Leaser and cache.Locker if c
+// implements them.
+func NewCache(c cache.Cacher, key Key, opts ...Option) (cache.Cacher, error) {
+	ret := &Cache{
+		cacher:  cache.AdaptCacher(c),
+		primary: key.ID,
+		aeads:   make(map[uint32]cipher.AEAD),
+	}
+	ret.setter, _ = c.(cache.ItemSetter)
+	for _, opt := range opts {
+		opt(ret)
+	}
+	for _, k := range append([]Key{key}, ret.oldKeys...) {
+		if _, ok := ret.aeads[k.ID]; ok {
+			return nil, errors.New("encryption: duplicate key ID")
+		}
+		block, err := aes.NewCipher(k.Secret)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		ret.aeads[k.ID] = aead
+	}
+	ret.oldKeys = nil
+
+	return cache.ForwardLeases(ret, c), nil
+}
+
+// additionalData returns the associated data of the value of the key.
+func additionalData(header []byte, key *datastorepb.Key) []byte {
+	return append(header[:headerSize:headerSize], cachekey.Encode(key)...)
+}
+
+// encrypt returns the value encrypted by the primary key. The value consists
+// of the header byte, the key ID, the nonce and the sealed value.
+func (c *Cache) encrypt(key *datastorepb.Key, b []byte) ([]byte, error) {
+	if b == nil {
+		return nil, nil
+	}
+	aead := c.aeads[c.primary]
+	ret := make([]byte, headerSize+aead.NonceSize(), headerSize+aead.NonceSize()+len(b)+aead.Overhead())
+	ret[0] = header
+	binary.BigEndian.PutUint32(ret[1:headerSize], c.primary)
+	nonce := ret[headerSize:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(ret, nonce, b, additionalData(ret, key)), nil
+}
+
+// decrypt returns the value encrypted by encrypt.
+func (c *Cache) decrypt(key *datastorepb.Key, b []byte) ([]byte, error) {
+	if len(b) < headerSize || b[0] != header {
+		return nil, errInvalidValue
+	}
+	aead, ok := c.aeads[binary.BigEndian.Uint32(b[1:headerSize])]
+	if !ok || len(b) < headerSize+aead.NonceSize() {
+		return nil, errInvalidValue
+	}
+	nonce := b[headerSize : headerSize+aead.NonceSize()]
+	// An empty value is not nil, which means missing.
+	return aead.Open([]byte{}, nonce, b[headerSize+aead.NonceSize():], additionalData(b, key))
+}
+
+// GetMulti returns the decrypted values of the given keys. Values that cannot
+// be decrypted are treated as missing, and are deleted so that they can be
+// filled again.
+func (c *Cache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	ret, _ := c.GetMultiWithError(ctx, keys)
+	return ret
+}
+
+// GetMultiWithError is the same as GetMulti except that it returns the error
+// of the Cacher.
+func (c *Cache) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/encryption.GetMulti")
+	defer func() { span.End() }()
+
+	return cache.DecodeMulti(ctx, c.cacher, keys, c.decryptMulti)
+}
+
+// decryptMulti is a cache.Decoder that decrypts the values.
+func (c *Cache) decryptMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) ([][]byte, []*datastorepb.Key, error) {
+	ret := make([][]byte, len(keys))
+	var invalid []*datastorepb.Key
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+		if b, err := c.decrypt(keys[i], v); err == nil {
+			ret[i] = b
+		} else {
+			invalid = append(invalid, keys[i])
+		}
+	}
+	return ret, invalid, nil
+}
+
+// SetMulti encrypts the given values and saves them.
+func (c *Cache) SetMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) {
+	c.SetMultiWithError(ctx, keys, values)
+}
+
+// SetMultiWithError is the same as SetMulti except that it returns the error
+// of the encryption or the Cacher.
+func (c *Cache) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/encryption.SetMulti")
+	defer func() { span.End() }()
+
+	vs := make([][]byte, len(values))
+	for i, v := range values {
+		var err error
+		if vs[i], err = c.encrypt(keys[i], v); err != nil {
+			return err
+		}
+	}
+	return c.cacher.SetMultiWithError(ctx, keys, vs)
+}
+
+// SetItems encrypts the values of the given items and saves them by SetItems
+// of the Cacher if it implements cache.ItemSetter, or by SetMulti.
+func (c *Cache) SetItems(ctx context.Context, items []*cache.Item) error {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/encryption.SetItems")
+	defer func() { span.End() }()
+
+	if c.setter == nil {
+		keys := make([]*datastorepb.Key, len(items))
+		values := make([][]byte, len(items))
+		for i, v := range items {
+			keys[i] = v.Key
+			values[i] = v.Value
+		}
+		return c.SetMultiWithError(ctx, keys, values)
+	}
+
+	encrypted := make([]*cache.Item, len(items))
+	for i, v := range items {
+		item := *v
+		var err error
+		if item.Value, err = c.encrypt(v.Key, v.Value); err != nil {
+			return err
+		}
+		encrypted[i] = &item
+	}
+	return c.setter.SetItems(ctx, encrypted)
+}
+
+// DeleteMulti deletes the values of the given keys.
+func (c *Cache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	return c.cacher.DeleteMulti(ctx, keys)
+}
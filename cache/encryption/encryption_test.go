@@ -0,0 +1,175 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/memory"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+)
+
+var keys = []*datastorepb.Key{
+	{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+	{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}}},
+	{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 3}}}},
+}
+
+var (
+	key1 = Key{ID: 1, Secret: bytes.Repeat([]byte{1}, 32)}
+	key2 = Key{ID: 2, Secret: bytes.Repeat([]byte{2}, 16)}
+)
+
+func TestCache(t *testing.T) {
+	backend := memory.NewCache(cache.Expiration{})
+	c, err := NewCache(backend, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := [][]byte{{'a'}, {}, nil}
+	c.SetMulti(context.Background(), keys, values)
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, values) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, values)
+	}
+
+	saved := backend.GetMulti(context.Background(), keys)
+	if len(saved[0]) <= headerSize || saved[0][0] != header {
+		t.Errorf("saved value = %v, want to be encrypted", saved[0])
+	}
+	if saved[2] != nil {
+		t.Errorf("saved value = %v, want nil", saved[2])
+	}
+
+	// A value swapped between keys cannot be decrypted.
+	backend.SetMulti(context.Background(), keys[1:2], saved[:1])
+	want := [][]byte{{'a'}, nil}
+	if got := c.GetMulti(context.Background(), keys[:2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+
+	// Plaintext values are treated as missing, including the soft-expiring
+	// values of the interceptor.
+	for _, v := range [][]byte{{0x0a, 'a'}, {0x01, 0, 0, 0, 0, 0, 0, 0, 0, 0x0a, 'a'}} {
+		backend.SetMulti(context.Background(), keys[:1], [][]byte{v})
+		if got := c.GetMulti(context.Background(), keys[:1]); got[0] != nil {
+			t.Errorf("Cache.GetMulti() = %v, want nil", got)
+		}
+	}
+}
+
+func TestCache_Rotation(t *testing.T) {
+	backend := memory.NewCache(cache.Expiration{})
+	old, err := NewCache(backend, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.SetMulti(context.Background(), keys[:1], [][]byte{{'a'}})
+
+	rotated, err := NewCache(backend, key2, WithDecryptionKeys(key1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated.SetMulti(context.Background(), keys[1:2], [][]byte{{'b'}})
+	want := [][]byte{{'a'}, {'b'}}
+	if got := rotated.GetMulti(context.Background(), keys[:2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+
+	// The values of the removed key are treated as missing.
+	removed, err := NewCache(backend, key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = [][]byte{nil, {'b'}}
+	if got := removed.GetMulti(context.Background(), keys[:2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+}
+
+func TestCache_RotationWithInterceptor(t *testing.T) {
+	ctx := context.Background()
+	var calls int
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		calls++
+		out := reply.(*datastorepb.LookupResponse)
+		for _, k := range req.(*datastorepb.LookupRequest).GetKeys() {
+			out.Found = append(out.Found, &datastorepb.EntityResult{Entity: &datastorepb.Entity{Key: k}, Version: 1})
+		}
+		return nil
+	}
+	lookup := func(c cache.Cacher) {
+		req := &datastorepb.LookupRequest{Keys: keys[:1]}
+		if err := cache.UnaryClientInterceptor(c)(ctx, "/google.datastore.v1.Datastore/Lookup", req, &datastorepb.LookupResponse{}, nil, invoker); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	backend := memory.NewCache(cache.Expiration{})
+	old, err := NewCache(backend, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup(old)
+	if calls != 1 {
+		t.Fatalf("calls = %v, want 1", calls)
+	}
+
+	// The values of the removed key are deleted and filled again with the
+	// new key.
+	rotated, err := NewCache(backend, key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls = 0
+	for i := 0; i < 3; i++ {
+		lookup(rotated)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %v, want 1", calls)
+	}
+}
+
+func TestCache_SetItems(t *testing.T) {
+	c, err := NewCache(memory.NewCache(cache.Expiration{}), key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locker, ok := c.(cache.Locker)
+	if !ok {
+		t.Fatal("NewCache() does not implement cache.Locker")
+	}
+	leases, err := locker.LeaseMulti(context.Background(), keys[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := locker.SetItems(context.Background(), []*cache.Item{
+		{Key: keys[0], Value: []byte{'a'}, Lease: leases[0]},
+		{Key: keys[1], Value: []byte{'b'}, Lease: leases[0] + 1},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{{'a'}, nil}
+	if got := c.GetMulti(context.Background(), keys[:2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+}
+
+func TestNewCache(t *testing.T) {
+	if _, err := NewCache(memory.NewCache(cache.Expiration{}), Key{ID: 1, Secret: []byte("short")}); err == nil {
+		t.Error("NewCache() error = nil, want an error of the invalid key size")
+	}
+	if _, err := NewCache(memory.NewCache(cache.Expiration{}), key1, WithDecryptionKeys(key1)); err == nil {
+		t.Error("NewCache() error = nil, want an error of the duplicate key ID")
+	}
+	c, err := NewCache(struct{ cache.Cacher }{memory.NewCache(cache.Expiration{})}, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.(cache.Leaser); ok {
+		t.Error("NewCache() implements cache.Leaser, want not to implement it for a Cacher")
+	}
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Expiration is the expiration of the items saved by a Cacher. The expiration
+// of each item is chosen uniformly at random from Min to Max, so that the
+// items saved at the same time do not expire at the same time. The zero value
+// means no expiration.
+type Expiration struct {
+	// Min is the minimum expiration. If it is not positive and Max is
+	// greater than it, the minimum is 1ns so that items always expire.
+	Min time.Duration
+
+	// Max is the maximum expiration. If it is not greater than Min, the
+	// expiration is always Min.
+	Max time.Duration
+}
+
+// TTL returns the Expiration of ttl without jitter.
+func TTL(ttl time.Duration) Expiration {
+	return Expiration{Min: ttl, Max: ttl}
+}
+
+// TTLJitter returns the Expiration of ttl with the jitter of the percentage of
+// ttl. For example, TTLJitter(time.Hour, 10) expires items in 54 to 66
+// minutes. The percent is limited to less than 100.
+func TTLJitter(ttl time.Duration, percent float64) Expiration {
+	if percent < 0 {
+		percent = 0
+	}
+	if percent >= 100 {
+		percent = 99
+	}
+	d := time.Duration(float64(ttl) * percent / 100)
+	return Expiration{Min: ttl - d, Max: ttl + d}
+}
+
+// TTLRange returns the Expiration from min to max.
+func TTLRange(min, max time.Duration) Expiration {
+	return Expiration{Min: min, Max: max}
+}
+
+// Next returns the expiration of an item to be saved. If it is 0, the item has
+// no expiration.
+func (e Expiration) Next() time.Duration {
+	if e.Max <= e.Min {
+		return e.Min
+	}
+	min := e.Min
+	if min <= 0 {
+		// 0 means no expiration.
+		min = 1
+	}
+	return min + time.Duration(rand.Int63n(int64(e.Max-min)+1))
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiration_Next(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiration Expiration
+		min, max   time.Duration
+	}{
+		{
+			name: "no expiration",
+		},
+		{
+			name:       "TTL",
+			expiration: TTL(1 * time.Minute),
+			min:        1 * time.Minute,
+			max:        1 * time.Minute,
+		},
+		{
+			name:       "TTLJitter",
+			expiration: TTLJitter(1*time.Hour, 10),
+			min:        54 * time.Minute,
+			max:        66 * time.Minute,
+		},
+		{
+			name:       "TTLJitter over 100%",
+			expiration: TTLJitter(1*time.Hour, 200),
+			min:        36 * time.Second,
+			max:        119*time.Minute + 24*time.Second,
+		},
+		{
+			name:       "TTLRange",
+			expiration: TTLRange(1*time.Minute, 2*time.Minute),
+			min:        1 * time.Minute,
+			max:        2 * time.Minute,
+		},
+		{
+			name:       "range from 0",
+			expiration: TTLRange(0, 2),
+			min:        1,
+			max:        2,
+		},
+		{
+			name:       "range from negative",
+			expiration: TTLRange(-1*time.Minute, 2),
+			min:        1,
+			max:        2,
+		},
+		{
+			name:       "reversed range",
+			expiration: TTLRange(2*time.Minute, 1*time.Minute),
+			min:        2 * time.Minute,
+			max:        2 * time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(map[time.Duration]bool)
+			for i := 0; i < 100; i++ {
+				got := tt.expiration.Next()
+				if got < tt.min || got > tt.max {
+					t.Fatalf("Expiration.Next() = %v, want in [%v, %v]", got, tt.min, tt.max)
+				}
+				seen[got] = true
+			}
+			if tt.min < tt.max && len(seen) == 1 {
+				t.Errorf("Expiration.Next() always returns the same expiration")
+			}
+		})
+	}
+}
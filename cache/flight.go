@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"context"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// flightGroup coalesces the concurrent lookups of the same keys so that only
+// one Lookup is called for a key at a time.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a lookup of a key in progress.
+type flight struct {
+	done chan struct{}
+
+	// result is the result of the key, or nil if the lookup failed or the
+	// key was deferred.
+	result  *datastorepb.EntityResult
+	missing bool
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// flightKey returns the key of the flights of the key in the project.
+func flightKey(projectID string, key *datastorepb.Key) string {
+	return projectID + "\x00" + keyString(key)
+}
+
+// start starts the flights of the keys that are not looked up by others. It
+// returns the keys to be looked up by the caller and their flights indexed by
+// keyString, and the keys looked up by others and their flights.
+func (g *flightGroup) start(projectID string, keys []*datastorepb.Key) (started []*datastorepb.Key, startedFlights map[string]*flight, joined []*datastorepb.Key, joinedFlights []*flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	startedFlights = make(map[string]*flight, len(keys))
+	for _, k := range keys {
+		fk := flightKey(projectID, k)
+		if f, ok := g.flights[fk]; ok {
+			joined = append(joined, k)
+			joinedFlights = append(joinedFlights, f)
+			continue
+		}
+		f := &flight{done: make(chan struct{})}
+		g.flights[fk] = f
+		started = append(started, k)
+		startedFlights[keyString(k)] = f
+	}
+	return started, startedFlights, joined, joinedFlights
+}
+
+// finish sets the results to the flights started by start, and notifies the
+// callers waiting for them.
+func (g *flightGroup) finish(projectID string, flights map[string]*flight, found, missing []*datastorepb.EntityResult) {
+	for _, v := range found {
+		if f := flights[keyString(v.GetEntity().GetKey())]; f != nil {
+			f.result = v
+		}
+	}
+	for _, v := range missing {
+		if f := flights[keyString(v.GetEntity().GetKey())]; f != nil {
+			f.result = v
+			f.missing = true
+		}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for ks, f := range flights {
+		fk := projectID + "\x00" + ks
+		if g.flights[fk] == f {
+			delete(g.flights, fk)
+		}
+		close(f.done)
+	}
+}
+
+// forget removes the flights of the keys so that the later lookups of them
+// start new flights. The callers waiting for the removed flights still get
+// their results.
+func (g *flightGroup) forget(projectID string, keys []*datastorepb.Key) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for _, k := range keys {
+		delete(g.flights, flightKey(projectID, k))
+	}
+}
+
+// wait waits for the flights, and returns the copies of their results. It
+// also returns the keys whose flights have no results.
+func wait(ctx context.Context, keys []*datastorepb.Key, flights []*flight) (found, missing []*datastorepb.EntityResult, failed []*datastorepb.Key, err error) {
+	for i, f := range flights {
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return nil, nil, nil, ctx.Err()
+		}
+		switch {
+		case f.result == nil:
+			failed = append(failed, keys[i])
+		case f.missing:
+			missing = append(missing, proto.Clone(f.result).(*datastorepb.EntityResult))
+		default:
+			found = append(found, proto.Clone(f.result).(*datastorepb.EntityResult))
+		}
+	}
+	return found, missing, failed, nil
+}
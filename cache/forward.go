@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// ItemCacher is a Cacher that implements ItemSetter.
+type ItemCacher interface {
+	Cacher
+	ItemSetter
+}
+
+// ForwardLeases returns c that also implements Leaser and Locker if inner
+// implements them, by forwarding LeaseMulti and LockMulti to inner. It is for
+// a Cacher that wraps inner and saves the value of each key with the same key
+// of inner, so that the items saved by c.SetItems are checked against the
+// leases and locks of inner. The returned Cacher implements ErrorCacher by
+// AdaptCacher(c).
+func ForwardLeases(c ItemCacher, inner Cacher) Cacher {
+	switch inner := inner.(type) {
+	case Locker:
+		return &lockForwarder{leaseForwarder{c, AdaptCacher(c), inner}, inner}
+	case Leaser:
+		return &leaseForwarder{c, AdaptCacher(c), inner}
+	}
+	return c
+}
+
+// leaseForwarder is an ItemCacher that forwards LeaseMulti to a Leaser.
+type leaseForwarder struct {
+	ItemCacher
+	ecacher ErrorCacher
+	leaser  Leaser
+}
+
+func (c *leaseForwarder) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	return c.ecacher.GetMultiWithError(ctx, keys)
+}
+
+func (c *leaseForwarder) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	return c.ecacher.SetMultiWithError(ctx, keys, values)
+}
+
+func (c *leaseForwarder) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	return c.leaser.LeaseMulti(ctx, keys)
+}
+
+// lockForwarder is an ItemCacher that forwards LeaseMulti and LockMulti to a
+// Locker.
+type lockForwarder struct {
+	leaseForwarder
+	locker Locker
+}
+
+func (c *lockForwarder) LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error {
+	return c.locker.LockMulti(ctx, keys, expiration)
+}
@@ -0,0 +1,116 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/memory"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+var forwardKey = &datastorepb.Key{
+	Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Name{Name: "1"}}},
+}
+
+// itemCacher hides the methods other than the ones of cache.ItemCacher.
+type itemCacher struct {
+	cache.ItemCacher
+}
+
+// errorCacher is an itemCacher that returns err from the methods of
+// cache.ErrorCacher.
+type errorCacher struct {
+	itemCacher
+	err error
+}
+
+func (c *errorCacher) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	return nil, c.err
+}
+
+func (c *errorCacher) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	return c.err
+}
+
+func TestForwardLeases(t *testing.T) {
+	tests := []struct {
+		name       string
+		inner      func(c *memory.Cache) cache.Cacher
+		wantLeaser bool
+		wantLocker bool
+	}{
+		{
+			name:  "Cacher",
+			inner: func(c *memory.Cache) cache.Cacher { return struct{ cache.Cacher }{c} },
+		},
+		{
+			name: "Leaser",
+			inner: func(c *memory.Cache) cache.Cacher {
+				return struct {
+					cache.Cacher
+					cache.Leaser
+				}{c, c}
+			},
+			wantLeaser: true,
+		},
+		{
+			name:       "Locker",
+			inner:      func(c *memory.Cache) cache.Cacher { return c },
+			wantLeaser: true,
+			wantLocker: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			backend := memory.NewCache(cache.Expiration{})
+			c := cache.ForwardLeases(itemCacher{backend}, tt.inner(backend))
+
+			leaser, ok := c.(cache.Leaser)
+			if ok != tt.wantLeaser {
+				t.Fatalf("ForwardLeases() implements cache.Leaser = %v, want %v", ok, tt.wantLeaser)
+			}
+			if _, ok := c.(cache.Locker); ok != tt.wantLocker {
+				t.Errorf("ForwardLeases() implements cache.Locker = %v, want %v", ok, tt.wantLocker)
+			}
+			if !ok {
+				return
+			}
+
+			leases, err := leaser.LeaseMulti(ctx, []*datastorepb.Key{forwardKey})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := leaser.SetItems(ctx, []*cache.Item{{Key: forwardKey, Value: []byte{'a'}, Lease: leases[0]}}); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.GetMulti(ctx, []*datastorepb.Key{forwardKey}); got[0] == nil {
+				t.Error("Cache.GetMulti() = nil, want the value saved with the lease")
+			}
+
+			if locker, ok := c.(cache.Locker); ok {
+				if err := locker.LockMulti(ctx, []*datastorepb.Key{forwardKey}, 1*time.Hour); err != nil {
+					t.Fatal(err)
+				}
+				if got := c.GetMulti(ctx, []*datastorepb.Key{forwardKey}); got[0] != nil {
+					t.Errorf("Cache.GetMulti() = %v, want nil for the locked key", got[0])
+				}
+			}
+		})
+	}
+}
+
+func TestForwardLeases_ErrorCacher(t *testing.T) {
+	wantErr := errors.New("error")
+	backend := memory.NewCache(cache.Expiration{})
+	c := cache.AdaptCacher(cache.ForwardLeases(&errorCacher{itemCacher{backend}, wantErr}, backend))
+	if _, err := c.GetMultiWithError(context.Background(), []*datastorepb.Key{forwardKey}); err != wantErr {
+		t.Errorf("GetMultiWithError() error = %v, want %v", err, wantErr)
+	}
+	if err := c.SetMultiWithError(context.Background(), []*datastorepb.Key{forwardKey}, [][]byte{{'a'}}); err != wantErr {
+		t.Errorf("SetMultiWithError() error = %v, want %v", err, wantErr)
+	}
+}
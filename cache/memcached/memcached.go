@@ -0,0 +1,361 @@
+/*
+Package memcached provides memcached cache that implements cache.Cacher
+interface, e.g. for Cloud Memorystore for Memcached.
+*/
+package memcached
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cacheitem"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cachekey"
+	"github.com/bradfitz/gomemcache/memcache"
+	"go.opencensus.io/trace"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+const (
+	// maxKeyLength is the maximum length of memcached keys.
+	maxKeyLength = 250
+
+	// maxGetKeys is the maximum number of keys retrieved by a multi-get.
+	maxGetKeys = 100
+
+	// maxRelativeExpiration is the maximum expiration that memcached treats
+	// as relative to the current time.
+	maxRelativeExpiration = 30 * 24 * time.Hour
+
+	// maxConcurrency is the maximum number of the concurrent requests of an
+	// operation for multiple keys.
+	maxConcurrency = 16
+)
+
+// MultiError is returned by the operations for multiple keys when some of the
+// keys failed. Each element is the error for the key at the same index, or nil.
+type MultiError []error
+
+func (m MultiError) Error() string {
+	s, n := "", 0
+	for _, e := range m {
+		if e != nil {
+			if n == 0 {
+				s = e.Error()
+			}
+			n++
+		}
+	}
+	switch n {
+	case 0:
+		return "(0 errors)"
+	case 1:
+		return s
+	case 2:
+		return s + " (and 1 other error)"
+	}
+	return fmt.Sprintf("%s (and %d other errors)", s, n-1)
+}
+
+// multiError returns errs as a MultiError, or nil if all of them are nil.
+func multiError(errs []error) error {
+	for _, e := range errs {
+		if e != nil {
+			return MultiError(errs)
+		}
+	}
+	return nil
+}
+
+// parallel calls f for each index up to n concurrently, and returns the errors
+// of them.
+func parallel(n int, f func(i int) error) []error {
+	errs := make([]error, n)
+	if n == 1 {
+		errs[0] = f(0)
+		return errs
+	}
+	sem := make(chan struct{}, maxConcurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = f(i)
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// Cache is an implementation of cache.Cacher, cache.ErrorCacher and
+// cache.Locker by memcached.
+type Cache struct {
+	expiration cache.Expiration
+	client     *memcache.Client
+	keys       *cachekey.Encoder
+}
+
+// NewCache returns a new Cache with given expiration. If set to the zero
+// value, each item has no expiration time. The keys are encoded by cachekey.Encoder with the
+// given options, and are hashed if they are longer than the limit of
+// memcached.
+//
+// Except for GetMulti, memcached has no commands for multiple keys, so the
+// operations for multiple keys send a request for each key, up to 16 requests
+// concurrently. Set MaxIdleConns of the client to reuse the connections of
+// them.
+func NewCache(expiration cache.Expiration, client *memcache.Client, opts ...cachekey.Option) *Cache {
+	return &Cache{
+		expiration: expiration,
+		client:     client,
+		keys:       cachekey.NewEncoder(append([]cachekey.Option{cachekey.WithMaxLength(maxKeyLength)}, opts...)...),
+	}
+}
+
+// GetMulti returns the values of the given keys as a slice of []byte. If the
+// item is not found, the corresponding index of the return value will be nil.
+func (c *Cache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memcached.GetMulti")
+	defer func() { span.End() }()
+
+	ret, _ := c.getMulti(ctx, keys)
+	return ret
+}
+
+// GetMultiWithError is the same as GetMulti except that it returns the error
+// of memcached.
+func (c *Cache) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memcached.GetMultiWithError")
+	defer func() { span.End() }()
+
+	return c.getMulti(ctx, keys)
+}
+
+func (c *Cache) getMulti(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	key := make([]string, len(keys))
+	keymap := make(map[string][]int, len(keys))
+	for i, k := range keys {
+		ks := c.keys.Encode(k)
+		key[i] = ks
+		keymap[ks] = append(keymap[ks], i)
+	}
+
+	items, err := c.getItems(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([][]byte, len(keys))
+	for k, v := range items {
+		// A lease is missing.
+		value := cacheitem.Value(v.Value)
+		for _, i := range keymap[k] {
+			ret[i] = value
+		}
+	}
+	return ret, nil
+}
+
+// getItems retrieves the items of the keys by multi-gets of up to maxGetKeys
+// keys.
+func (c *Cache) getItems(keys []string) (map[string]*memcache.Item, error) {
+	items := make(map[string]*memcache.Item, len(keys))
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxGetKeys {
+			n = maxGetKeys
+		}
+		got, err := c.client.GetMulti(keys[:n])
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range got {
+			items[k] = v
+		}
+		keys = keys[n:]
+	}
+	return items, nil
+}
+
+// SetMulti sets the given keys and values to items.
+func (c *Cache) SetMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memcached.SetMulti")
+	defer func() { span.End() }()
+
+	c.setMulti(ctx, keys, values)
+}
+
+// SetMultiWithError is the same as SetMulti except that it returns the error
+// of memcached.
+func (c *Cache) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memcached.SetMultiWithError")
+	defer func() { span.End() }()
+
+	return c.setMulti(ctx, keys, values)
+}
+
+// setMulti sets all items even if some of them fail, and returns a MultiError
+// for the failed keys.
+func (c *Cache) setMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	return multiError(parallel(len(keys), func(i int) error {
+		return c.client.Set(&memcache.Item{Key: c.keys.Encode(keys[i]), Value: values[i], Expiration: expirationSeconds(c.expiration.Next())})
+	}))
+}
+
+// DeleteMulti deletes items for the given keys. It deletes all keys even if
+// some of them fail, and returns a MultiError for the keys that exist and could
+// not be deleted.
+func (c *Cache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memcached.DeleteMulti")
+	defer func() { span.End() }()
+
+	return multiError(parallel(len(keys), func(i int) error {
+		if err := c.client.Delete(c.keys.Encode(keys[i])); err != memcache.ErrCacheMiss {
+			return err
+		}
+		return nil
+	}))
+}
+
+// LeaseMulti acquires leases for the given keys that have neither an item nor
+// a lease.
+func (c *Cache) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memcached.LeaseMulti")
+	defer func() { span.End() }()
+
+	leases := make([]uint64, len(keys))
+	errs := parallel(len(keys), func(i int) error {
+		l, err := cacheitem.NewLease()
+		if err != nil {
+			return err
+		}
+		err = c.client.Add(&memcache.Item{
+			Key:        c.keys.Encode(keys[i]),
+			Value:      cacheitem.Lease(l),
+			Expiration: expirationSeconds(cacheitem.LeaseExpiration),
+		})
+		switch err {
+		case nil:
+			leases[i] = l
+		case memcache.ErrNotStored:
+			// The item or another lease exists.
+		default:
+			return err
+		}
+		return nil
+	})
+	if err := multiError(errs); err != nil {
+		return nil, err
+	}
+	return leases, nil
+}
+
+// SetItems sets the given items. An item with a lease is set only if the lease
+// is held, and an item without a lease is not set if the key has a lease or a
+// lock, or the item has a newer version. An item with Replace is set only if
+// the key has an item. It sets all items even if some of them fail, and returns
+// a MultiError for the failed items.
+func (c *Cache) SetItems(ctx context.Context, items []*cache.Item) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memcached.SetItems")
+	defer func() { span.End() }()
+
+	if len(items) == 0 {
+		return nil
+	}
+	keys := make([]string, len(items))
+	for i, v := range items {
+		keys[i] = c.keys.Encode(v.Key)
+	}
+	got, err := c.getItems(keys)
+	if err != nil {
+		return err
+	}
+
+	return multiError(parallel(len(items), func(i int) error {
+		v, ks := items[i], keys[i]
+		value := v.Value
+		if v.Version != 0 {
+			value = cacheitem.Versioned(v.Version, v.Value)
+		}
+
+		cur, ok := got[ks]
+		switch {
+		case v.Lease != 0:
+			if !ok || !bytes.Equal(cur.Value, cacheitem.Lease(v.Lease)) {
+				return nil
+			}
+		case !ok && v.Replace:
+			return nil
+		case !ok:
+			return ignoreConflict(c.client.Add(&memcache.Item{Key: ks, Value: value, Expiration: c.itemExpiration(v)}))
+		case cacheitem.IsLease(cur.Value):
+			// Leased or locked by others.
+			return nil
+		case v.Version != 0 && cacheitem.Version(cur.Value) > v.Version:
+			return nil
+		}
+		// The items of duplicate keys share cur.
+		item := *cur
+		item.Value = value
+		item.Expiration = c.itemExpiration(v)
+		return ignoreConflict(c.client.CompareAndSwap(&item))
+	}))
+}
+
+// itemExpiration returns the expiration of the item, or the expiration of the
+// Cache if the item does not have it.
+func (c *Cache) itemExpiration(item *cache.Item) int32 {
+	if item.Expiration != 0 {
+		return expirationSeconds(item.Expiration)
+	}
+	return expirationSeconds(c.expiration.Next())
+}
+
+// ignoreConflict returns nil if the error is caused by a concurrent update.
+func ignoreConflict(err error) error {
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return nil
+	}
+	return err
+}
+
+// LockMulti locks the given keys until the expiration. It locks all keys even
+// if some of them fail, and returns a MultiError for the failed keys.
+func (c *Cache) LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memcached.LockMulti")
+	defer func() { span.End() }()
+
+	exp := expirationSeconds(expiration)
+	return multiError(parallel(len(keys), func(i int) error {
+		// A lock is a lease that is never held by anyone.
+		l, err := cacheitem.NewLease()
+		if err != nil {
+			return err
+		}
+		return c.client.Set(&memcache.Item{Key: c.keys.Encode(keys[i]), Value: cacheitem.Lease(l), Expiration: exp})
+	}))
+}
+
+// expirationSeconds converts the expiration to the expiration of memcached in
+// seconds. An expiration longer than 30 days is converted to the Unix time
+// since memcached treats it as an absolute time.
+func expirationSeconds(expiration time.Duration) int32 {
+	switch {
+	case expiration <= 0:
+		return 0
+	case expiration < time.Second:
+		// 0 means no expiration.
+		return 1
+	case expiration > maxRelativeExpiration:
+		return int32(time.Now().Add(expiration).Unix())
+	}
+	return int32(expiration / time.Second)
+}
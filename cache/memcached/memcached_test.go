@@ -0,0 +1,639 @@
+package memcached
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cacheitem"
+	"github.com/bradfitz/gomemcache/memcache"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+var server *fakeServer
+
+func TestMain(m *testing.M) {
+	var err error
+	server, err = newFakeServer()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	code := m.Run()
+	server.Close()
+	os.Exit(code)
+}
+
+func newClient(t *testing.T, items ...*memcache.Item) *memcache.Client {
+	t.Helper()
+
+	server.flush()
+	client := memcache.New(server.Addr())
+	for _, v := range items {
+		if err := client.Set(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return client
+}
+
+func TestCache_GetMulti(t *testing.T) {
+	type fields struct {
+		items []*memcache.Item
+	}
+	type args struct {
+		keys []*datastorepb.Key
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   [][]byte
+	}{
+		{
+			name: "found 2 items",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: []byte{'a'}},
+				{Key: "v1///k/i2", Value: []byte{'b'}},
+			}},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+				},
+			}},
+			want: [][]byte{{'a'}, {'b'}},
+		},
+		{
+			name: "1 found 1 not found",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i2", Value: []byte{'b'}},
+			}},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+				},
+			}},
+			want: [][]byte{nil, {'b'}},
+		},
+		{
+			name: "leased",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: cacheitem.Lease(1)},
+			}},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+			}},
+			want: [][]byte{nil},
+		},
+		{
+			name: "versioned",
+			fields: fields{items: []*memcache.Item{
+				{Key: "v1///k/i1", Value: cacheitem.Versioned(1, []byte{'a'})},
+			}},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+			}},
+			want: [][]byte{{'a'}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(cache.Expiration{}, newClient(t, tt.fields.items...))
+			if got := c.GetMulti(context.Background(), tt.args.keys); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cache.GetMulti() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCache_GetMulti_manyKeys(t *testing.T) {
+	keys := make([]*datastorepb.Key, maxGetKeys*2+1)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = &datastorepb.Key{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: int64(i + 1)}}},
+		}
+		values[i] = []byte(strconv.Itoa(i))
+	}
+	// A key longer than the limit of memcached.
+	keys[0].Path[0].IdType = &datastorepb.Key_PathElement_Name{Name: strings.Repeat("a", maxKeyLength)}
+
+	c := NewCache(cache.Expiration{}, newClient(t))
+	if err := c.SetMultiWithError(context.Background(), keys, values); err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetMultiWithError(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, values) {
+		t.Errorf("Cache.GetMultiWithError() = %v, want %v", got, values)
+	}
+	if n := server.gets(); n != 3 {
+		t.Errorf("multi-gets = %v, want %v", n, 3)
+	}
+}
+
+func TestCache_LeaseMulti_manyKeys(t *testing.T) {
+	keys := make([]*datastorepb.Key, maxConcurrency*2+1)
+	for i := range keys {
+		keys[i] = &datastorepb.Key{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: int64(i + 1)}}},
+		}
+	}
+	c := NewCache(cache.Expiration{}, newClient(t))
+	leases, err := c.LeaseMulti(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := make([]*cache.Item, len(keys))
+	values := make([][]byte, len(keys))
+	for i, l := range leases {
+		if l == 0 {
+			t.Fatalf("Cache.LeaseMulti()[%d] = 0, want a lease", i)
+		}
+		values[i] = []byte(strconv.Itoa(i))
+		items[i] = &cache.Item{Key: keys[i], Value: values[i], Lease: l}
+	}
+	if err := c.SetItems(context.Background(), items); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, values) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, values)
+	}
+
+	if err := c.LockMulti(context.Background(), keys, 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, make([][]byte, len(keys))) {
+		t.Errorf("Cache.GetMulti() = %v, want all keys to be locked", got)
+	}
+}
+
+func TestCache_SetMulti(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+		},
+	}
+
+	client := newClient(t)
+	c := NewCache(cache.TTL(1*time.Hour), client)
+	c.SetMulti(context.Background(), keys, [][]byte{{'a'}, {'b'}})
+	for k, want := range map[string]string{"v1///k/i1": "a", "v1///k/i2": "b"} {
+		item, err := client.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(item.Value) != want {
+			t.Errorf("Item %v = %s, want %s", k, item.Value, want)
+		}
+		if exp := server.expiration(k); exp != 3600 {
+			t.Errorf("Expiration of %v = %v, want %v", k, exp, 3600)
+		}
+	}
+}
+
+func TestCache_DeleteMulti(t *testing.T) {
+	client := newClient(t,
+		&memcache.Item{Key: "v1///k/i1", Value: []byte{'a'}},
+		&memcache.Item{Key: "v1///k/i2", Value: []byte{'b'}},
+	)
+	keys := []*datastorepb.Key{
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 3}}},
+		},
+	}
+
+	c := NewCache(cache.Expiration{}, client)
+	if err := c.DeleteMulti(context.Background(), keys); err != nil {
+		t.Fatalf("Cache.DeleteMulti() error = %v, want nil for missing keys", err)
+	}
+	if _, err := client.Get("v1///k/i1"); err != memcache.ErrCacheMiss {
+		t.Errorf("Get() error = %v, want %v", err, memcache.ErrCacheMiss)
+	}
+	if _, err := client.Get("v1///k/i2"); err != nil {
+		t.Errorf("Get() error = %v, want nil", err)
+	}
+}
+
+func TestCache_LeaseMulti(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 3}}},
+		},
+	}
+
+	c := NewCache(cache.Expiration{}, newClient(t,
+		&memcache.Item{Key: "v1///k/i1", Value: []byte{'a'}},
+		&memcache.Item{Key: "v1///k/i2", Value: cacheitem.Lease(1)},
+	))
+	leases, err := c.LeaseMulti(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leases[0] != 0 || leases[1] != 0 || leases[2] == 0 {
+		t.Errorf("Cache.LeaseMulti() = %v, want a lease only for the missing key", leases)
+	}
+}
+
+func TestCache_SetItems(t *testing.T) {
+	key := &datastorepb.Key{
+		Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+	}
+	tests := []struct {
+		name  string
+		items []*memcache.Item
+		item  *cache.Item
+		want  []byte
+	}{
+		{
+			name: "without lease",
+			item: &cache.Item{Key: key, Value: []byte{'a'}},
+			want: []byte{'a'},
+		},
+		{
+			name:  "lease held",
+			items: []*memcache.Item{{Key: "v1///k/i1", Value: cacheitem.Lease(1)}},
+			item:  &cache.Item{Key: key, Value: []byte{'a'}, Lease: 1},
+			want:  []byte{'a'},
+		},
+		{
+			name: "lease released",
+			item: &cache.Item{Key: key, Value: []byte{'a'}, Lease: 1},
+		},
+		{
+			name:  "lease taken over",
+			items: []*memcache.Item{{Key: "v1///k/i1", Value: cacheitem.Lease(2)}},
+			item:  &cache.Item{Key: key, Value: []byte{'a'}, Lease: 1},
+		},
+		{
+			name:  "leased by others",
+			items: []*memcache.Item{{Key: "v1///k/i1", Value: cacheitem.Lease(2)}},
+			item:  &cache.Item{Key: key, Value: []byte{'a'}, Version: 1},
+		},
+		{
+			name: "version without item",
+			item: &cache.Item{Key: key, Value: []byte{'b'}, Version: 1},
+			want: []byte{'b'},
+		},
+		{
+			name:  "newer version",
+			items: []*memcache.Item{{Key: "v1///k/i1", Value: cacheitem.Versioned(1, []byte{'a'})}},
+			item:  &cache.Item{Key: key, Value: []byte{'b'}, Version: 2},
+			want:  []byte{'b'},
+		},
+		{
+			name:  "older version",
+			items: []*memcache.Item{{Key: "v1///k/i1", Value: cacheitem.Versioned(2, []byte{'a'})}},
+			item:  &cache.Item{Key: key, Value: []byte{'b'}, Version: 1},
+			want:  []byte{'a'},
+		},
+		{
+			name:  "without version",
+			items: []*memcache.Item{{Key: "v1///k/i1", Value: cacheitem.Versioned(2, []byte{'a'})}},
+			item:  &cache.Item{Key: key, Value: []byte{'b'}},
+			want:  []byte{'b'},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCache(cache.Expiration{}, newClient(t, tt.items...))
+			if err := c.SetItems(context.Background(), []*cache.Item{tt.item}); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.GetMulti(context.Background(), []*datastorepb.Key{key}); !reflect.DeepEqual(got, [][]byte{tt.want}) {
+				t.Errorf("Cache.GetMulti() = %v, want %v", got, [][]byte{tt.want})
+			}
+		})
+	}
+}
+
+func TestCache_LockMulti(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+		},
+	}
+
+	c := NewCache(cache.Expiration{}, newClient(t, &memcache.Item{Key: "v1///k/i1", Value: []byte{'a'}}))
+	leases, err := c.LeaseMulti(context.Background(), keys[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LockMulti(context.Background(), keys, 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want locked keys to be missing", got)
+	}
+	if got, _ := c.LeaseMulti(context.Background(), keys); !reflect.DeepEqual(got, []uint64{0, 0}) {
+		t.Errorf("Cache.LeaseMulti() = %v, want no leases for locked keys", got)
+	}
+	if err := c.SetItems(context.Background(), []*cache.Item{{Key: keys[1], Value: []byte{'b'}, Lease: leases[0]}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want a lease acquired before locking to be released", got)
+	}
+	if err := c.SetItems(context.Background(), []*cache.Item{{Key: keys[0], Value: []byte{'c'}, Version: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want an item without a lease not to overwrite the lock", got)
+	}
+
+	if err := c.DeleteMulti(context.Background(), keys); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.LeaseMulti(context.Background(), keys); got[0] == 0 || got[1] == 0 {
+		t.Errorf("Cache.LeaseMulti() = %v, want leases for unlocked keys", got)
+	}
+}
+
+func TestCache_GetMultiWithError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	c := NewCache(cache.Expiration{}, memcache.New(addr))
+	keys := []*datastorepb.Key{
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+	}
+	if _, err := c.GetMultiWithError(context.Background(), keys); err == nil {
+		t.Error("Cache.GetMultiWithError() error = nil, want error of closed server")
+	}
+	if err := c.SetMultiWithError(context.Background(), keys, [][]byte{{'a'}}); err == nil {
+		t.Error("Cache.SetMultiWithError() error = nil, want error of closed server")
+	}
+}
+
+func TestCache_MultiError(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+		},
+	}
+
+	client := newClient(t)
+	server.failKeys("v1///k/i1")
+	c := NewCache(cache.Expiration{}, client)
+
+	isFirstError := func(err error) bool {
+		merr, ok := err.(MultiError)
+		return ok && len(merr) == 2 && merr[0] != nil && merr[1] == nil
+	}
+	if err := c.SetMultiWithError(context.Background(), keys, [][]byte{{'a'}, {'b'}}); !isFirstError(err) {
+		t.Errorf("Cache.SetMultiWithError() error = %v, want MultiError only for the first key", err)
+	}
+	if got := c.GetMulti(context.Background(), keys[1:]); !reflect.DeepEqual(got, [][]byte{{'b'}}) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, [][]byte{{'b'}})
+	}
+	if err := c.SetItems(context.Background(), []*cache.Item{{Key: keys[0], Value: []byte{'c'}}, {Key: keys[1], Value: []byte{'c'}}}); !isFirstError(err) {
+		t.Errorf("Cache.SetItems() error = %v, want MultiError only for the first key", err)
+	}
+	if got := c.GetMulti(context.Background(), keys[1:]); !reflect.DeepEqual(got, [][]byte{{'c'}}) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, [][]byte{{'c'}})
+	}
+	if err := c.DeleteMulti(context.Background(), keys); !isFirstError(err) {
+		t.Errorf("Cache.DeleteMulti() error = %v, want MultiError only for the first key", err)
+	}
+	if got := c.GetMulti(context.Background(), keys[1:]); !reflect.DeepEqual(got, [][]byte{nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want the second key to be deleted", got)
+	}
+}
+
+func Test_expirationSeconds(t *testing.T) {
+	tests := []struct {
+		name       string
+		expiration time.Duration
+		want       int32
+	}{
+		{name: "no expiration", expiration: 0, want: 0},
+		{name: "less than a second", expiration: time.Millisecond, want: 1},
+		{name: "relative", expiration: 1 * time.Hour, want: 3600},
+		{name: "absolute", expiration: 31 * 24 * time.Hour, want: int32(time.Now().Add(31 * 24 * time.Hour).Unix())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := expirationSeconds(tt.expiration); got < tt.want || got > tt.want+1 {
+				t.Errorf("expirationSeconds() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeServer is an in-process memcached server that supports the text
+// protocol commands used by Cache. Expirations are recorded but not applied.
+type fakeServer struct {
+	l net.Listener
+
+	mu       sync.Mutex
+	items    map[string]*fakeItem
+	cas      uint64
+	getCalls int
+	fail     map[string]bool
+}
+
+type fakeItem struct {
+	value []byte
+	flags uint32
+	exp   int32
+	cas   uint64
+}
+
+func newFakeServer() (*fakeServer, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &fakeServer{l: l, items: make(map[string]*fakeItem)}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, nil
+}
+
+func (s *fakeServer) Addr() string {
+	return s.l.Addr().String()
+}
+
+func (s *fakeServer) Close() error {
+	return s.l.Close()
+}
+
+func (s *fakeServer) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.items = make(map[string]*fakeItem)
+	s.getCalls = 0
+	s.fail = nil
+}
+
+// failKeys makes the writes of the keys fail until the next flush.
+func (s *fakeServer) failKeys(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fail = make(map[string]bool, len(keys))
+	for _, k := range keys {
+		s.fail[k] = true
+	}
+}
+
+// gets returns the number of get commands since the last flush.
+func (s *fakeServer) gets() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.getCalls
+}
+
+func (s *fakeServer) expiration(key string) int32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if v, ok := s.items[key]; ok {
+		return v.exp
+	}
+	return -1
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			return
+		}
+		if err := s.handle(rw, args); err != nil {
+			return
+		}
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeServer) handle(rw *bufio.ReadWriter, args []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch args[0] {
+	case "get", "gets":
+		s.getCalls++
+		for _, k := range args[1:] {
+			if v, ok := s.items[k]; ok {
+				fmt.Fprintf(rw, "VALUE %s %d %d %d\r\n%s\r\n", k, v.flags, len(v.value), v.cas, v.value)
+			}
+		}
+		_, err := rw.WriteString("END\r\n")
+		return err
+
+	case "set", "add", "cas":
+		if len(args) < 5 {
+			return fmt.Errorf("invalid command: %v", args)
+		}
+		flags, _ := strconv.ParseUint(args[2], 10, 32)
+		exp, _ := strconv.ParseInt(args[3], 10, 32)
+		size, err := strconv.Atoi(args[4])
+		if err != nil {
+			return err
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(rw, value); err != nil {
+			return err
+		}
+
+		cur, ok := s.items[args[1]]
+		switch {
+		case s.fail[args[1]]:
+			_, err := rw.WriteString("SERVER_ERROR out of memory\r\n")
+			return err
+		case args[0] == "add" && ok:
+			_, err := rw.WriteString("NOT_STORED\r\n")
+			return err
+		case args[0] == "cas" && !ok:
+			_, err := rw.WriteString("NOT_FOUND\r\n")
+			return err
+		case args[0] == "cas" && (len(args) < 6 || args[5] != strconv.FormatUint(cur.cas, 10)):
+			_, err := rw.WriteString("EXISTS\r\n")
+			return err
+		}
+		s.cas++
+		s.items[args[1]] = &fakeItem{value: value[:size], flags: uint32(flags), exp: int32(exp), cas: s.cas}
+		_, err = rw.WriteString("STORED\r\n")
+		return err
+
+	case "delete":
+		if s.fail[args[1]] {
+			_, err := rw.WriteString("SERVER_ERROR out of memory\r\n")
+			return err
+		}
+		if _, ok := s.items[args[1]]; !ok {
+			_, err := rw.WriteString("NOT_FOUND\r\n")
+			return err
+		}
+		delete(s.items, args[1])
+		_, err := rw.WriteString("DELETED\r\n")
+		return err
+	}
+	_, err := rw.WriteString("ERROR\r\n")
+	return err
+}
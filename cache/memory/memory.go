@@ -1,39 +1,227 @@
 /*
 Package memory provides in-memory cache that implements cache.Cacher interface.
+
+By default, the Cache is unbounded and expired items are kept until they are
+overwritten or deleted. WithMaxItems and WithMaxBytes bound the Cache by
+evicting the least recently used items, and WithJanitor removes expired items
+periodically. Leases and locks are never evicted since they would no longer
+prevent stale values from being saved. Instead, the expired leases and locks
+of a bounded Cache are deleted when they outnumber the unexpired ones, even
+without WithJanitor.
+
+The Cache is locked by a single lock. ShardedCache distributes keys to
+multiple Caches to reduce the lock contention under many concurrent calls.
 */
 package memory
 
 import (
+	"container/list"
 	"context"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cacheitem"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cachekey"
 	"go.opencensus.io/trace"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 )
 
+// minLeases is the minimum number of leases and locks in a bounded Cache at
+// which the expired ones are deleted.
+const minLeases = 1024
+
 type item struct {
-	value []byte
-	exp   int64
+	value   []byte
+	exp     int64
+	lease   uint64
+	version int64
 }
 
-// Cache is an implementation of cache.Cacher using map type with an expiration
-// time for each item.
+// Cache is an implementation of cache.Cacher and cache.Locker using map type
+// with an expiration time for each item.
 type Cache struct {
 	mu         sync.RWMutex
-	expiration time.Duration
+	expiration cache.Expiration
 	items      map[string]item
+	lease      uint64
+
+	// The following fields are used only if the Cache is bounded. The front
+	// of lru is the most recently used key. Leases and locks are not in lru,
+	// but in leases, and the expired ones are deleted when the number of
+	// them reaches maxLeases.
+	maxItems  int
+	maxBytes  int64
+	bytes     int64
+	lru       *list.List
+	elems     map[string]*list.Element
+	leases    map[string]struct{}
+	maxLeases int
+
+	janitorInterval time.Duration
+	stop            chan struct{}
+	stopOnce        sync.Once
+}
+
+// Option configures the Cache returned by NewCache.
+type Option func(*Cache)
+
+// WithMaxItems returns an Option that limits the number of items. When the
+// limit is exceeded, the least recently used items are evicted. Leases and
+// locks are not counted, and are kept until they expire.
+func WithMaxItems(n int) Option {
+	return func(c *Cache) {
+		c.maxItems = n
+	}
+}
+
+// WithMaxBytes returns an Option that limits the total bytes of the keys and
+// the values. When the limit is exceeded, the least recently used items are
+// evicted. A value larger than the limit is not saved.
+func WithMaxBytes(n int64) Option {
+	return func(c *Cache) {
+		c.maxBytes = n
+	}
+}
+
+// WithJanitor returns an Option that removes expired items every interval by
+// a goroutine. The goroutine is stopped by Close.
+func WithJanitor(interval time.Duration) Option {
+	return func(c *Cache) {
+		c.janitorInterval = interval
+	}
 }
 
-// NewCache returns a new Cache with given expiration. If set to 0, each item
-// has no expiration time.
-func NewCache(expiration time.Duration) *Cache {
-	return &Cache{
+// NewCache returns a new Cache with given expiration. If set to the zero
+// value, each item has no expiration time.
+func NewCache(expiration cache.Expiration, opts ...Option) *Cache {
+	c := &Cache{
 		expiration: expiration,
 		items:      make(map[string]item),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.maxItems > 0 || c.maxBytes > 0 {
+		c.lru = list.New()
+		c.elems = make(map[string]*list.Element)
+		c.leases = make(map[string]struct{})
+		c.maxLeases = minLeases
+	}
+	if c.janitorInterval > 0 {
+		c.stop = make(chan struct{})
+		go c.janitor()
+	}
+	return c
+}
+
+// Close stops the goroutine started by WithJanitor. The Cache can be used
+// after Close, but expired items are no longer removed periodically.
+func (c *Cache) Close() {
+	if c.stop != nil {
+		c.stopOnce.Do(func() { close(c.stop) })
+	}
+}
+
+func (c *Cache) janitor() {
+	ticker := time.NewTicker(c.janitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.deleteExpired()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// deleteExpired deletes the expired items and leases.
+func (c *Cache) deleteExpired() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	for ks, v := range c.items {
+		if v.exp != 0 && v.exp < now {
+			c.delete(ks)
+		}
+	}
+}
+
+// Flush deletes all items, leases and locks.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.items = make(map[string]item)
+	if c.lru != nil {
+		c.lru.Init()
+		c.elems = make(map[string]*list.Element)
+		c.bytes = 0
+		c.leases = make(map[string]struct{})
+		c.maxLeases = minLeases
+	}
+}
+
+// set saves the item, and evicts the least recently used items if the Cache
+// is bounded.
+func (c *Cache) set(ks string, v item) {
+	if c.lru == nil {
+		c.items[ks] = v
+		return
+	}
+
+	c.delete(ks)
+	if v.lease != 0 {
+		// Leases and locks are not evicted.
+		if len(c.leases) >= c.maxLeases {
+			c.deleteExpiredLeases()
+		}
+		c.leases[ks] = struct{}{}
+		c.items[ks] = v
+		return
+	}
+	size := int64(len(ks) + len(v.value))
+	if c.maxBytes > 0 && size > c.maxBytes {
+		return
+	}
+	c.elems[ks] = c.lru.PushFront(ks)
+	c.items[ks] = v
+	c.bytes += size
+
+	for (c.maxItems > 0 && c.lru.Len() > c.maxItems) || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.delete(c.lru.Back().Value.(string))
+	}
+}
+
+// deleteExpiredLeases deletes the expired leases and locks, and doubles the
+// number of the unexpired ones to delete them next time.
+func (c *Cache) deleteExpiredLeases() {
+	now := time.Now().UnixNano()
+	for ks := range c.leases {
+		if c.items[ks].exp < now {
+			c.delete(ks)
+		}
+	}
+	c.maxLeases = 2 * len(c.leases)
+	if c.maxLeases < minLeases {
+		c.maxLeases = minLeases
+	}
+}
+
+// delete deletes the item.
+func (c *Cache) delete(ks string) {
+	if c.lru != nil {
+		if elem, ok := c.elems[ks]; ok {
+			c.bytes -= int64(len(ks) + len(c.items[ks].value))
+			c.lru.Remove(elem)
+			delete(c.elems, ks)
+		}
+		delete(c.leases, ks)
+	}
+	delete(c.items, ks)
 }
 
 // GetMulti returns the values of the given keys as a slice of []byte. If the
@@ -42,21 +230,33 @@ func (c *Cache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte
 	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.GetMulti")
 	defer func() { span.End() }()
 
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-
 	ret := make([][]byte, len(keys))
+	c.getMulti(encodeKeys(keys), ret)
+	return ret
+}
+
+// getMulti sets the values of the keys to ret.
+func (c *Cache) getMulti(keys []string, ret [][]byte) {
+	if c.lru != nil {
+		// The recency of the items is updated.
+		c.mu.Lock()
+		defer c.mu.Unlock()
+	} else {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+	}
 
 	now := time.Now().UnixNano()
-	for i, k := range keys {
-		if v, ok := c.items[keystr(k)]; ok {
-			if c.expiration == 0 || v.exp >= now {
+	for i, ks := range keys {
+		if v, ok := c.items[ks]; ok && v.lease == 0 {
+			if v.exp == 0 || v.exp >= now {
 				ret[i] = v.value
+				if c.lru != nil {
+					c.lru.MoveToFront(c.elems[ks])
+				}
 			}
 		}
 	}
-
-	return ret
 }
 
 // SetMulti sets the given keys and values to items.
@@ -64,16 +264,16 @@ func (c *Cache) SetMulti(ctx context.Context, keys []*datastorepb.Key, values []
 	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.SetMulti")
 	defer func() { span.End() }()
 
+	c.setMulti(encodeKeys(keys), values)
+}
+
+func (c *Cache) setMulti(keys []string, values [][]byte) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	var exp int64
-	if c.expiration != 0 {
-		exp = time.Now().Add(c.expiration).UnixNano()
-	}
-
-	for i, k := range keys {
-		c.items[keystr(k)] = item{value: values[i], exp: exp}
+	now := time.Now()
+	for i, ks := range keys {
+		c.set(ks, item{value: values[i], exp: c.expiresAt(now, 0)})
 	}
 }
 
@@ -83,32 +283,136 @@ func (c *Cache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error
 	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.DeleteMulti")
 	defer func() { span.End() }()
 
+	c.deleteMulti(encodeKeys(keys))
+	return nil
+}
+
+func (c *Cache) deleteMulti(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, ks := range keys {
+		c.delete(ks)
+	}
+}
+
+// LeaseMulti acquires leases for the given keys that have neither an unexpired
+// item nor an unexpired lease. The returned error is always nil.
+func (c *Cache) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.LeaseMulti")
+	defer func() { span.End() }()
+
+	ret := make([]uint64, len(keys))
+	c.leaseMulti(encodeKeys(keys), ret)
+	return ret, nil
+}
+
+// leaseMulti sets the acquired leases of the keys to ret.
+func (c *Cache) leaseMulti(keys []string, ret []uint64) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	for _, k := range keys {
-		delete(c.items, keystr(k))
+	now := time.Now()
+	for i, ks := range keys {
+		if v, ok := c.items[ks]; ok {
+			if v.lease != 0 && v.exp >= now.UnixNano() {
+				continue
+			}
+			if v.lease == 0 && (v.exp == 0 || v.exp >= now.UnixNano()) {
+				continue
+			}
+		}
+		c.lease++
+		c.set(ks, item{lease: c.lease, exp: now.Add(cacheitem.LeaseExpiration).UnixNano()})
+		ret[i] = c.lease
 	}
+}
+
+// SetItems sets the given items. An item with a lease is set only if the lease
+// is held, and an item without a lease is not set if the key has an unexpired
+// lease or lock, or an unexpired item with a newer version. An item with
+// Replace is set only if the key has an unexpired item. The returned error is
+// always nil.
+func (c *Cache) SetItems(ctx context.Context, items []*cache.Item) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.SetItems")
+	defer func() { span.End() }()
+
+	keys := make([]string, len(items))
+	for i, v := range items {
+		keys[i] = cachekey.Encode(v.Key)
+	}
+	c.setItems(keys, items)
 	return nil
 }
 
-func keystr(key *datastorepb.Key) string {
-	var b strings.Builder
+// setItems sets the items whose keys are encoded to keys.
+func (c *Cache) setItems(keys []string, items []*cache.Item) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	if ns := key.GetPartitionId().GetNamespaceId(); ns != "" {
-		b.WriteString(ns)
-	} else {
-		b.WriteString("[default]")
-	}
-	for _, p := range key.GetPath() {
-		b.WriteString(p.GetKind())
-		switch p.GetIdType().(type) {
-		case *datastorepb.Key_PathElement_Id:
-			b.WriteString(strconv.FormatInt(p.GetId(), 10))
-		case *datastorepb.Key_PathElement_Name:
-			b.WriteString(strconv.Quote(p.GetName()))
+	now := time.Now()
+	for i, v := range items {
+		ks := keys[i]
+		cur, ok := c.items[ks]
+		if ok && cur.exp != 0 && cur.exp < now.UnixNano() {
+			// Expired.
+			ok = false
 		}
+		switch {
+		case v.Lease != 0:
+			if !ok || cur.lease != v.Lease {
+				continue
+			}
+		case ok && cur.lease != 0:
+			// Leased or locked by others.
+			continue
+		case !ok && v.Replace:
+			continue
+		case ok && v.Version != 0 && cur.version > v.Version:
+			continue
+		}
+		c.set(ks, item{value: v.Value, exp: c.expiresAt(now, v.Expiration), version: v.Version})
 	}
+}
+
+// expiresAt returns the expiration time of an item saved at now in
+// nanoseconds. If expiration is 0, the expiration of the Cache is used.
+func (c *Cache) expiresAt(now time.Time, expiration time.Duration) int64 {
+	if expiration == 0 {
+		expiration = c.expiration.Next()
+	}
+	if expiration == 0 {
+		return 0
+	}
+	return now.Add(expiration).UnixNano()
+}
 
-	return b.String()
+// LockMulti locks the given keys until the expiration. The returned error is
+// always nil.
+func (c *Cache) LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.LockMulti")
+	defer func() { span.End() }()
+
+	c.lockMulti(encodeKeys(keys), expiration)
+	return nil
+}
+
+func (c *Cache) lockMulti(keys []string, expiration time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	exp := time.Now().Add(expiration).UnixNano()
+	for _, ks := range keys {
+		// A lock is a lease that is never held by anyone.
+		c.lease++
+		c.set(ks, item{lease: c.lease, exp: exp})
+	}
+}
+
+func encodeKeys(keys []*datastorepb.Key) []string {
+	ret := make([]string, len(keys))
+	for i, k := range keys {
+		ret[i] = cachekey.Encode(k)
+	}
+	return ret
 }
@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 )
 
@@ -28,7 +29,7 @@ func TestCache_GetMulti(t *testing.T) {
 			fields: fields{
 				expiration: 1 * time.Hour,
 				items: map[string]item{
-					"[default]k1": {value: []byte{'a'}, exp: time.Now().Add(1 * time.Hour).UnixNano()},
+					"v1///k/i1": {value: []byte{'a'}, exp: time.Now().Add(1 * time.Hour).UnixNano()},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -43,8 +44,8 @@ func TestCache_GetMulti(t *testing.T) {
 			fields: fields{
 				expiration: 1 * time.Hour,
 				items: map[string]item{
-					"[default]k1": {value: []byte{'a'}, exp: time.Now().Add(1 * time.Hour).UnixNano()},
-					"[default]k2": {value: []byte{'b'}, exp: time.Now().Add(1 * time.Hour).UnixNano()},
+					"v1///k/i1": {value: []byte{'a'}, exp: time.Now().Add(1 * time.Hour).UnixNano()},
+					"v1///k/i2": {value: []byte{'b'}, exp: time.Now().Add(1 * time.Hour).UnixNano()},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -75,8 +76,8 @@ func TestCache_GetMulti(t *testing.T) {
 			fields: fields{
 				expiration: 1,
 				items: map[string]item{
-					"[default]k1": {value: []byte{'a'}, exp: time.Now().UnixNano()},
-					"[default]k2": {value: []byte{'b'}, exp: time.Now().UnixNano()},
+					"v1///k/i1": {value: []byte{'a'}, exp: time.Now().UnixNano()},
+					"v1///k/i2": {value: []byte{'b'}, exp: time.Now().UnixNano()},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -93,7 +94,7 @@ func TestCache_GetMulti(t *testing.T) {
 			name: "1 found 1 not found",
 			fields: fields{
 				items: map[string]item{
-					"[default]k2": {value: []byte{'b'}},
+					"v1///k/i2": {value: []byte{'b'}},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -110,7 +111,7 @@ func TestCache_GetMulti(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			c := &Cache{
-				expiration: tt.fields.expiration,
+				expiration: cache.TTL(tt.fields.expiration),
 				items:      tt.fields.items,
 			}
 			if got := c.GetMulti(context.Background(), tt.args.keys); !reflect.DeepEqual(got, tt.want) {
@@ -141,7 +142,7 @@ func TestCache_SetMulti(t *testing.T) {
 				values: [][]byte{{'a'}},
 			},
 			want: map[string]item{
-				"[default]k1": {value: []byte{'a'}},
+				"v1///k/i1": {value: []byte{'a'}},
 			},
 		},
 		{
@@ -158,14 +159,14 @@ func TestCache_SetMulti(t *testing.T) {
 				values: [][]byte{{'a'}, {'b'}},
 			},
 			want: map[string]item{
-				"[default]k1": {value: []byte{'a'}},
-				"[default]k2": {value: []byte{'b'}},
+				"v1///k/i1": {value: []byte{'a'}},
+				"v1///k/i2": {value: []byte{'b'}},
 			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			c := NewCache(0)
+			c := NewCache(cache.Expiration{})
 			c.SetMulti(context.Background(), tt.args.keys, tt.args.values)
 			if got := c.items; !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Cache.SetMulti() = %v, want %v", got, tt.want)
@@ -192,8 +193,8 @@ func TestCache_DeleteMulti(t *testing.T) {
 			name: "1 item",
 			fields: fields{
 				items: map[string]item{
-					"[default]k1": {value: []byte{'a'}},
-					"[default]k2": {value: []byte{'b'}},
+					"v1///k/i1": {value: []byte{'a'}},
+					"v1///k/i2": {value: []byte{'b'}},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -202,15 +203,15 @@ func TestCache_DeleteMulti(t *testing.T) {
 				},
 			}},
 			want: map[string]item{
-				"[default]k2": {value: []byte{'b'}},
+				"v1///k/i2": {value: []byte{'b'}},
 			},
 		},
 		{
 			name: "2 items",
 			fields: fields{
 				items: map[string]item{
-					"[default]k1": {value: []byte{'a'}},
-					"[default]k2": {value: []byte{'b'}},
+					"v1///k/i1": {value: []byte{'a'}},
+					"v1///k/i2": {value: []byte{'b'}},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -237,39 +238,564 @@ func TestCache_DeleteMulti(t *testing.T) {
 	}
 }
 
-func Test_keystr(t *testing.T) {
+func TestCache_LeaseMulti(t *testing.T) {
+	type fields struct {
+		expiration time.Duration
+		items      map[string]item
+		lease      uint64
+	}
 	type args struct {
-		key *datastorepb.Key
+		keys []*datastorepb.Key
 	}
 	tests := []struct {
-		name string
-		args args
-		want string
+		name   string
+		fields fields
+		args   args
+		want   []uint64
+	}{
+		{
+			name:   "not found",
+			fields: fields{items: map[string]item{}},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+				},
+			}},
+			want: []uint64{1, 2},
+		},
+		{
+			name: "found",
+			fields: fields{
+				items: map[string]item{
+					"v1///k/i1": {value: []byte{'a'}},
+				},
+			},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+			}},
+			want: []uint64{0},
+		},
+		{
+			name: "expired item",
+			fields: fields{
+				expiration: 1,
+				items: map[string]item{
+					"v1///k/i1": {value: []byte{'a'}, exp: time.Now().UnixNano()},
+				},
+			},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+			}},
+			want: []uint64{1},
+		},
+		{
+			name: "leased",
+			fields: fields{
+				items: map[string]item{
+					"v1///k/i1": {lease: 1, exp: time.Now().Add(1 * time.Hour).UnixNano()},
+				},
+				lease: 1,
+			},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+				},
+			}},
+			want: []uint64{0, 2},
+		},
+		{
+			name: "expired lease",
+			fields: fields{
+				items: map[string]item{
+					"v1///k/i1": {lease: 1, exp: time.Now().UnixNano()},
+				},
+				lease: 1,
+			},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+			}},
+			want: []uint64{2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Cache{
+				expiration: cache.TTL(tt.fields.expiration),
+				items:      tt.fields.items,
+				lease:      tt.fields.lease,
+			}
+			got, err := c.LeaseMulti(context.Background(), tt.args.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cache.LeaseMulti() = %v, want %v", got, tt.want)
+			}
+			if v := c.GetMulti(context.Background(), tt.args.keys); v[0] != nil && tt.want[0] != 0 {
+				t.Errorf("Cache.GetMulti() = %v, want leased key to be missing", v)
+			}
+		})
+	}
+}
+
+func TestCache_SetItems(t *testing.T) {
+	type fields struct {
+		items map[string]item
+	}
+	type args struct {
+		items []*cache.Item
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   map[string]item
 	}{
 		{
-			name: "id",
-			args: args{key: &datastorepb.Key{
-				Path: []*datastorepb.Key_PathElement{
-					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+			name:   "without lease",
+			fields: fields{items: map[string]item{}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+				},
+			}},
+			want: map[string]item{
+				"v1///k/i1": {value: []byte{'a'}},
+			},
+		},
+		{
+			name: "lease held",
+			fields: fields{items: map[string]item{
+				"v1///k/i1": {lease: 1, exp: time.Now().Add(1 * time.Hour).UnixNano()},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+					Lease: 1,
+				},
+			}},
+			want: map[string]item{
+				"v1///k/i1": {value: []byte{'a'}},
+			},
+		},
+		{
+			name:   "lease released",
+			fields: fields{items: map[string]item{}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+					Lease: 1,
+				},
+			}},
+			want: map[string]item{},
+		},
+		{
+			name: "lease taken over",
+			fields: fields{items: map[string]item{
+				"v1///k/i1": {lease: 2, exp: time.Now().Add(1 * time.Hour).UnixNano()},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+					Lease: 1,
+				},
+			}},
+			want: map[string]item{
+				"v1///k/i1": {lease: 2},
+			},
+		},
+		{
+			name: "leased by others",
+			fields: fields{items: map[string]item{
+				"v1///k/i1": {lease: 2, exp: time.Now().Add(1 * time.Hour).UnixNano()},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'a'},
+					Version: 1,
+				},
+			}},
+			want: map[string]item{
+				"v1///k/i1": {lease: 2},
+			},
+		},
+		{
+			name: "expired lease",
+			fields: fields{items: map[string]item{
+				"v1///k/i1": {lease: 2, exp: time.Now().Add(-1 * time.Second).UnixNano()},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'a'},
+					Version: 1,
+				},
+			}},
+			want: map[string]item{
+				"v1///k/i1": {value: []byte{'a'}, version: 1},
+			},
+		},
+		{
+			name: "newer version",
+			fields: fields{items: map[string]item{
+				"v1///k/i1": {value: []byte{'a'}, version: 1},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'b'},
+					Version: 2,
+				},
+			}},
+			want: map[string]item{
+				"v1///k/i1": {value: []byte{'b'}, version: 2},
+			},
+		},
+		{
+			name: "older version",
+			fields: fields{items: map[string]item{
+				"v1///k/i1": {value: []byte{'a'}, version: 2},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'b'},
+					Version: 1,
+				},
+			}},
+			want: map[string]item{
+				"v1///k/i1": {value: []byte{'a'}, version: 2},
+			},
+		},
+		{
+			name: "without version",
+			fields: fields{items: map[string]item{
+				"v1///k/i1": {value: []byte{'a'}, version: 2},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'b'},
 				},
 			}},
-			want: `[default]kind1`,
+			want: map[string]item{
+				"v1///k/i1": {value: []byte{'b'}},
+			},
 		},
 		{
-			name: "name",
-			args: args{key: &datastorepb.Key{
-				Path: []*datastorepb.Key_PathElement{
-					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Name{Name: "name"}},
+			name: "replace",
+			fields: fields{items: map[string]item{
+				"v1///k/i1": {value: []byte{'a'}, version: 1},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'b'},
+					Version: 1,
+					Replace: true,
+				},
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+					},
+					Value:   []byte{'c'},
+					Version: 1,
+					Replace: true,
 				},
 			}},
-			want: `[default]kind"name"`,
+			want: map[string]item{
+				"v1///k/i1": {value: []byte{'b'}, version: 1},
+			},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := keystr(tt.args.key); got != tt.want {
-				t.Errorf("keystr() = %v, want %v", got, tt.want)
+			c := &Cache{items: tt.fields.items}
+			if err := c.SetItems(context.Background(), tt.args.items); err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string]item, len(c.items))
+			for k, v := range c.items {
+				if v.lease != 0 {
+					v.exp = 0
+				}
+				got[k] = v
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cache.SetItems() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestCache_SetItemsWithExpiration(t *testing.T) {
+	c := NewCache(cache.TTL(1 * time.Nanosecond))
+	keys := []*datastorepb.Key{
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}}},
+	}
+	if err := c.SetItems(context.Background(), []*cache.Item{
+		{Key: keys[0], Value: []byte{'a'}, Expiration: 1 * time.Hour},
+		{Key: keys[1], Value: []byte{'b'}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Millisecond)
+
+	want := [][]byte{{'a'}, nil}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+}
+
+func TestCache_LockMulti(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+		},
+	}
+
+	c := &Cache{items: map[string]item{
+		"v1///k/i1": {value: []byte{'a'}},
+	}}
+	leases, _ := c.LeaseMulti(context.Background(), keys[1:])
+	if err := c.LockMulti(context.Background(), keys, 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want locked keys to be missing", got)
+	}
+	if got, _ := c.LeaseMulti(context.Background(), keys); !reflect.DeepEqual(got, []uint64{0, 0}) {
+		t.Errorf("Cache.LeaseMulti() = %v, want no leases for locked keys", got)
+	}
+	c.SetItems(context.Background(), []*cache.Item{{Key: keys[1], Value: []byte{'b'}, Lease: leases[0]}})
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want a lease acquired before locking to be released", got)
+	}
+	c.SetItems(context.Background(), []*cache.Item{{Key: keys[0], Value: []byte{'c'}, Version: 3}})
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want an item without a lease not to overwrite the lock", got)
+	}
+
+	c.DeleteMulti(context.Background(), keys)
+	if got, _ := c.LeaseMulti(context.Background(), keys); got[0] == 0 || got[1] == 0 {
+		t.Errorf("Cache.LeaseMulti() = %v, want leases for unlocked keys", got)
+	}
+}
+
+func TestCache_MaxItems(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 3}}}},
+	}
+
+	c := NewCache(cache.Expiration{}, WithMaxItems(2))
+	c.SetMulti(context.Background(), keys[:2], [][]byte{{'a'}, {'b'}})
+	// Use the first key so that the second key is the least recently used.
+	c.GetMulti(context.Background(), keys[:1])
+	c.SetMulti(context.Background(), keys[2:], [][]byte{{'c'}})
+
+	want := [][]byte{{'a'}, nil, {'c'}}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+	if len(c.items) != 2 || c.lru.Len() != 2 {
+		t.Errorf("Items = %v, want %v", len(c.items), 2)
+	}
+}
+
+func TestCache_MaxItemsWithLeases(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 3}}}},
+	}
+
+	c := NewCache(cache.Expiration{}, WithMaxItems(1))
+	leases, _ := c.LeaseMulti(context.Background(), keys[:1])
+	if err := c.LockMulti(context.Background(), keys[1:2], 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	c.SetMulti(context.Background(), keys[2:], [][]byte{{'c'}})
+
+	// Neither the lease nor the lock is evicted by the item.
+	if err := c.SetItems(context.Background(), []*cache.Item{{Key: keys[1], Value: []byte{'b'}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetItems(context.Background(), []*cache.Item{{Key: keys[0], Value: []byte{'a'}, Lease: leases[0]}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The leased item evicts the other item.
+	want := [][]byte{{'a'}, nil, nil}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+	if len(c.items) != 2 || c.lru.Len() != 1 {
+		t.Errorf("Items = %v, LRU = %v, want %v, %v", len(c.items), c.lru.Len(), 2, 1)
+	}
+}
+
+func TestCache_MaxItemsWithExpiredLeases(t *testing.T) {
+	c := NewCache(cache.Expiration{}, WithMaxItems(1))
+	for i := 0; i < 10*minLeases; i++ {
+		key := &datastorepb.Key{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: int64(i + 1)}}}}
+		if err := c.LockMulti(context.Background(), []*datastorepb.Key{key}, 1*time.Nanosecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The expired locks are deleted without the janitor.
+	if len(c.items) > minLeases {
+		t.Errorf("Items = %v, want at most %v", len(c.items), minLeases)
+	}
+}
+
+func TestCache_MaxBytes(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 3}}}},
+	}
+	// Each key is 9 bytes long.
+	c := NewCache(cache.Expiration{}, WithMaxBytes(25))
+
+	c.SetMulti(context.Background(), keys[:2], [][]byte{{'a'}, {'b'}})
+	if want := [][]byte{{'a'}, {'b'}, nil}; !reflect.DeepEqual(c.GetMulti(context.Background(), keys), want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", c.GetMulti(context.Background(), keys), want)
+	}
+
+	c.SetMulti(context.Background(), keys[2:], [][]byte{{'c', 'c'}})
+	if want := [][]byte{nil, {'b'}, {'c', 'c'}}; !reflect.DeepEqual(c.GetMulti(context.Background(), keys), want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", c.GetMulti(context.Background(), keys), want)
+	}
+	if c.bytes != 21 {
+		t.Errorf("Bytes = %v, want %v", c.bytes, 21)
+	}
+
+	c.SetMulti(context.Background(), keys[1:2], [][]byte{make([]byte, 17)})
+	if want := [][]byte{nil, nil, {'c', 'c'}}; !reflect.DeepEqual(c.GetMulti(context.Background(), keys), want) {
+		t.Errorf("Cache.GetMulti() = %v, want a value larger than the limit to be discarded", c.GetMulti(context.Background(), keys))
+	}
+
+	c.DeleteMulti(context.Background(), keys)
+	if len(c.items) != 0 || c.lru.Len() != 0 || c.bytes != 0 {
+		t.Errorf("Items = %v, Bytes = %v, want empty", len(c.items), c.bytes)
+	}
+}
+
+func TestCache_Janitor(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}}},
+	}
+
+	c := NewCache(cache.TTL(1*time.Millisecond), WithJanitor(1*time.Millisecond), WithMaxItems(10))
+	defer c.Close()
+
+	c.SetMulti(context.Background(), keys[:1], [][]byte{{'a'}})
+	c.SetItems(context.Background(), []*cache.Item{{Key: keys[1], Value: []byte{'b'}, Expiration: 1 * time.Hour}})
+	time.Sleep(50 * time.Millisecond)
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, ok := c.items["v1///k/i1"]; ok || len(c.items) != 1 || c.lru.Len() != 1 {
+		t.Errorf("Items = %v, want expired items to be removed", c.items)
+	}
+}
+
+func TestCache_Close(t *testing.T) {
+	c := NewCache(cache.Expiration{}, WithJanitor(1*time.Millisecond))
+	c.Close()
+	c.Close()
+
+	select {
+	case <-c.stop:
+	default:
+		t.Error("Cache.Close() did not stop the janitor")
+	}
+}
+
+func TestCache_Flush(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}}},
+	}
+
+	c := NewCache(cache.Expiration{}, WithMaxItems(10))
+	c.SetMulti(context.Background(), keys[:1], [][]byte{{'a'}})
+	c.LockMulti(context.Background(), keys[1:], 1*time.Hour)
+	c.Flush()
+
+	if len(c.items) != 0 || c.lru.Len() != 0 || c.bytes != 0 {
+		t.Errorf("Items = %v, want empty", c.items)
+	}
+	if got, _ := c.LeaseMulti(context.Background(), keys); got[0] == 0 || got[1] == 0 {
+		t.Errorf("Cache.LeaseMulti() = %v, want leases for flushed keys", got)
+	}
+}
+
+func TestCache_Jitter(t *testing.T) {
+	keys := make([]*datastorepb.Key, 100)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = &datastorepb.Key{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: int64(i + 1)}}}}
+		values[i] = []byte{'a'}
+	}
+
+	c := NewCache(cache.TTLRange(1*time.Hour, 2*time.Hour))
+	now := time.Now()
+	c.SetMulti(context.Background(), keys, values)
+
+	exps := make(map[int64]bool)
+	for _, v := range c.items {
+		if exp := time.Unix(0, v.exp); exp.Before(now.Add(1*time.Hour)) || exp.After(time.Now().Add(2*time.Hour)) {
+			t.Fatalf("expiration = %v, want in 1 to 2 hours", exp.Sub(now))
+		}
+		exps[v.exp] = true
+	}
+	if len(exps) == 1 {
+		t.Error("all items have the same expiration")
+	}
+}
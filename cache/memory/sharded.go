@@ -0,0 +1,206 @@
+package memory
+
+import (
+	"context"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cachekey"
+	"go.opencensus.io/trace"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// ShardedCache is an implementation of cache.Cacher and cache.Locker that
+// distributes keys to Caches locked independently, to reduce the lock
+// contention of concurrent calls.
+type ShardedCache struct {
+	shards []*Cache
+}
+
+// NewShardedCache returns a new ShardedCache with the given number of shards.
+// Each shard is a Cache created by NewCache with the expiration and the
+// options. The limits of WithMaxItems and WithMaxBytes are divided among the
+// shards.
+func NewShardedCache(expiration cache.Expiration, shards int, opts ...Option) *ShardedCache {
+	if shards < 1 {
+		shards = 1
+	}
+	c := &ShardedCache{shards: make([]*Cache, shards)}
+	for i := range c.shards {
+		s := NewCache(expiration, opts...)
+		s.maxItems = divideLimit(int64(s.maxItems), shards)
+		s.maxBytes = int64(divideLimit(s.maxBytes, shards))
+		// Leases are unique among the shards.
+		s.lease = uint64(i) << 48
+		c.shards[i] = s
+	}
+	return c
+}
+
+// divideLimit returns the limit of each of n shards rounded up.
+func divideLimit(limit int64, n int) int {
+	return int((limit + int64(n) - 1) / int64(n))
+}
+
+// Close stops the goroutines started by WithJanitor.
+func (c *ShardedCache) Close() {
+	for _, s := range c.shards {
+		s.Close()
+	}
+}
+
+// Flush deletes all items, leases and locks of all shards.
+func (c *ShardedCache) Flush() {
+	for _, s := range c.shards {
+		s.Flush()
+	}
+}
+
+// shardRange is the range of the sorted keys distributed to a shard.
+type shardRange struct {
+	shard, start, end int
+}
+
+// split encodes the keys and sorts them by shard. It returns the sorted keys,
+// their indexes in keys and the ranges of the shards that have the keys.
+func (c *ShardedCache) split(keys []*datastorepb.Key) ([]string, []int, []shardRange) {
+	encoded := make([]string, len(keys))
+	shards := make([]int, len(keys))
+	offsets := make([]int, len(c.shards)+1)
+	for i, k := range keys {
+		encoded[i] = cachekey.Encode(k)
+		shards[i] = shardIndex(encoded[i], len(c.shards))
+		offsets[shards[i]+1]++
+	}
+
+	var ranges []shardRange
+	for i := range c.shards {
+		if n := offsets[i+1]; n > 0 {
+			ranges = append(ranges, shardRange{shard: i, start: offsets[i], end: offsets[i] + n})
+		}
+		offsets[i+1] += offsets[i]
+	}
+
+	sorted := make([]string, len(keys))
+	indexes := make([]int, len(keys))
+	for i, s := range shards {
+		j := offsets[s]
+		offsets[s]++
+		sorted[j] = encoded[i]
+		indexes[j] = i
+	}
+	return sorted, indexes, ranges
+}
+
+// shardIndex returns the index of the shard of the key by 32-bit FNV-1a.
+func shardIndex(ks string, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(ks); i++ {
+		h ^= uint32(ks[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
+
+// GetMulti returns the values of the given keys as a slice of []byte. If the
+// item has expired, the corresponding index of the return value will be nil.
+func (c *ShardedCache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.ShardedCache.GetMulti")
+	defer func() { span.End() }()
+
+	sorted, indexes, ranges := c.split(keys)
+	values := make([][]byte, len(keys))
+	for _, r := range ranges {
+		c.shards[r.shard].getMulti(sorted[r.start:r.end], values[r.start:r.end])
+	}
+
+	ret := make([][]byte, len(keys))
+	for i, v := range values {
+		ret[indexes[i]] = v
+	}
+	return ret
+}
+
+// SetMulti sets the given keys and values to items.
+func (c *ShardedCache) SetMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.ShardedCache.SetMulti")
+	defer func() { span.End() }()
+
+	sorted, indexes, ranges := c.split(keys)
+	vs := make([][]byte, len(values))
+	for i, j := range indexes {
+		vs[i] = values[j]
+	}
+	for _, r := range ranges {
+		c.shards[r.shard].setMulti(sorted[r.start:r.end], vs[r.start:r.end])
+	}
+}
+
+// DeleteMulti deletes items for the given keys. The returned error is always
+// nil.
+func (c *ShardedCache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.ShardedCache.DeleteMulti")
+	defer func() { span.End() }()
+
+	sorted, _, ranges := c.split(keys)
+	for _, r := range ranges {
+		c.shards[r.shard].deleteMulti(sorted[r.start:r.end])
+	}
+	return nil
+}
+
+// LeaseMulti acquires leases for the given keys that have neither an unexpired
+// item nor an unexpired lease. The returned error is always nil.
+func (c *ShardedCache) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.ShardedCache.LeaseMulti")
+	defer func() { span.End() }()
+
+	sorted, indexes, ranges := c.split(keys)
+	leases := make([]uint64, len(keys))
+	for _, r := range ranges {
+		c.shards[r.shard].leaseMulti(sorted[r.start:r.end], leases[r.start:r.end])
+	}
+
+	ret := make([]uint64, len(keys))
+	for i, v := range leases {
+		ret[indexes[i]] = v
+	}
+	return ret, nil
+}
+
+// SetItems sets the given items. An item with a lease is set only if the lease
+// is held, and an item without a lease is not set if the key has an unexpired
+// lease or lock, or an unexpired item with a newer version. An item with
+// Replace is set only if the key has an unexpired item. The returned error is
+// always nil.
+func (c *ShardedCache) SetItems(ctx context.Context, items []*cache.Item) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.ShardedCache.SetItems")
+	defer func() { span.End() }()
+
+	keys := make([]*datastorepb.Key, len(items))
+	for i, v := range items {
+		keys[i] = v.Key
+	}
+	sorted, indexes, ranges := c.split(keys)
+	vs := make([]*cache.Item, len(items))
+	for i, j := range indexes {
+		vs[i] = items[j]
+	}
+	for _, r := range ranges {
+		c.shards[r.shard].setItems(sorted[r.start:r.end], vs[r.start:r.end])
+	}
+	return nil
+}
+
+// LockMulti locks the given keys until the expiration. The returned error is
+// always nil.
+func (c *ShardedCache) LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/memory.ShardedCache.LockMulti")
+	defer func() { span.End() }()
+
+	sorted, _, ranges := c.split(keys)
+	for _, r := range ranges {
+		c.shards[r.shard].lockMulti(sorted[r.start:r.end], expiration)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package memory
+
+import (
+	"context"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+func TestShardedCache(t *testing.T) {
+	keys := make([]*datastorepb.Key, 20)
+	values := make([][]byte, len(keys))
+	for i := range keys {
+		keys[i] = &datastorepb.Key{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: int64(i + 1)}}},
+		}
+		values[i] = []byte(strconv.Itoa(i))
+	}
+
+	c := NewShardedCache(cache.Expiration{}, 4)
+	c.SetMulti(context.Background(), keys[:10], values[:10])
+	want := append(append([][]byte{}, values[:10]...), make([][]byte, 10)...)
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("ShardedCache.GetMulti() = %v, want %v", got, want)
+	}
+	used := 0
+	for _, s := range c.shards {
+		if len(s.items) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Errorf("Shards used = %v, want keys to be distributed", used)
+	}
+
+	leases, _ := c.LeaseMulti(context.Background(), keys)
+	for i, l := range leases {
+		if (l != 0) != (i >= 10) {
+			t.Fatalf("ShardedCache.LeaseMulti() = %v, want leases for missing keys", leases)
+		}
+	}
+	if err := c.SetItems(context.Background(), []*cache.Item{
+		{Key: keys[10], Value: []byte{'a'}, Lease: leases[10]},
+		{Key: keys[11], Value: []byte{'b'}, Lease: leases[10]},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LockMulti(context.Background(), keys[:1], 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.GetMulti(context.Background(), keys[:3]), [][]byte{nil, values[1], values[2]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ShardedCache.GetMulti() = %v, want %v", got, want)
+	}
+	if got := c.GetMulti(context.Background(), keys[10:12]); !reflect.DeepEqual(got, [][]byte{{'a'}, nil}) {
+		t.Errorf("ShardedCache.GetMulti() = %v, want only the item with its lease", got)
+	}
+
+	if err := c.DeleteMulti(context.Background(), keys); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range c.shards {
+		if len(s.items) > 0 {
+			t.Errorf("Items = %v, want empty", s.items)
+		}
+	}
+}
+
+func TestNewShardedCache(t *testing.T) {
+	c := NewShardedCache(cache.Expiration{}, 3, WithMaxItems(10), WithMaxBytes(100))
+	for _, s := range c.shards {
+		if s.maxItems != 4 || s.maxBytes != 34 {
+			t.Errorf("Limits = %v, %v, want %v, %v", s.maxItems, s.maxBytes, 4, 34)
+		}
+	}
+}
+
+type benchmarkCacher interface {
+	cache.Cacher
+	cache.ItemSetter
+}
+
+// benchmarkMixed runs GetMulti concurrently and SetItems or DeleteMulti for
+// every writeRate calls.
+func benchmarkMixed(b *testing.B, c benchmarkCacher, writeRate int) {
+	const numKeys = 10000
+	keys := make([]*datastorepb.Key, numKeys)
+	for i := range keys {
+		keys[i] = &datastorepb.Key{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: int64(i + 1)}}},
+		}
+		c.SetMulti(context.Background(), keys[i:i+1], [][]byte{{'a'}})
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewSource(rand.Int63()))
+		for n := 0; pb.Next(); n++ {
+			i := r.Intn(numKeys - 10)
+			switch {
+			case n%writeRate != 0:
+				c.GetMulti(context.Background(), keys[i:i+10])
+			case n%(writeRate*2) == 0:
+				c.DeleteMulti(context.Background(), keys[i:i+1])
+			default:
+				c.SetItems(context.Background(), []*cache.Item{{Key: keys[i], Value: []byte{'b'}}})
+			}
+		}
+	})
+}
+
+func BenchmarkCache_Mixed(b *testing.B) {
+	b.Run("read", func(b *testing.B) { benchmarkMixed(b, NewCache(cache.Expiration{}), 100) })
+	b.Run("mixed", func(b *testing.B) { benchmarkMixed(b, NewCache(cache.Expiration{}), 10) })
+	b.Run("write", func(b *testing.B) { benchmarkMixed(b, NewCache(cache.Expiration{}), 2) })
+	b.Run("bounded", func(b *testing.B) { benchmarkMixed(b, NewCache(cache.Expiration{}, WithMaxItems(100000)), 10) })
+}
+
+func BenchmarkShardedCache_Mixed(b *testing.B) {
+	b.Run("read", func(b *testing.B) { benchmarkMixed(b, NewShardedCache(cache.Expiration{}, 32), 100) })
+	b.Run("mixed", func(b *testing.B) { benchmarkMixed(b, NewShardedCache(cache.Expiration{}, 32), 10) })
+	b.Run("write", func(b *testing.B) { benchmarkMixed(b, NewShardedCache(cache.Expiration{}, 32), 2) })
+	b.Run("bounded", func(b *testing.B) {
+		benchmarkMixed(b, NewShardedCache(cache.Expiration{}, 32, WithMaxItems(100000)), 10)
+	})
+}
@@ -0,0 +1,137 @@
+package cache
+
+import (
+	"context"
+
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// The following measures are recorded by the interceptor returned by
+// UnaryClientInterceptor.
+var (
+	LookupKeys         = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/lookup_keys", "Number of keys looked up without transactions", stats.UnitDimensionless)
+	Hits               = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/hits", "Number of keys found in the cache", stats.UnitDimensionless)
+	Misses             = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/misses", "Number of keys not found in the cache", stats.UnitDimensionless)
+	Fills              = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/fills", "Number of items saved to the cache", stats.UnitDimensionless)
+	FillBytes          = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/fill_bytes", "Total bytes of values saved to the cache", stats.UnitBytes)
+	Invalidations      = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/invalidations", "Number of keys deleted from the cache", stats.UnitDimensionless)
+	InvalidationErrors = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/invalidation_errors", "Number of keys failed to be deleted from the cache", stats.UnitDimensionless)
+	Skips              = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/skips", "Number of items not saved to the cache because they are too large", stats.UnitDimensionless)
+	Refreshes          = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/refreshes", "Number of stale keys refreshed in the background", stats.UnitDimensionless)
+	Coalesced          = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/coalesced", "Number of missing keys waiting for the lookups by other calls", stats.UnitDimensionless)
+)
+
+// The following tags are applied to the measures.
+var (
+	// KeyKind is the kind of the keys.
+	KeyKind = tag.MustNewKey("kind")
+
+	// KeyNamespace is the namespace of the keys. It is not set for the
+	// default namespace.
+	KeyNamespace = tag.MustNewKey("namespace")
+
+	// KeyBackend is the name of the Cacher set by WithBackendName.
+	KeyBackend = tag.MustNewKey("backend")
+)
+
+// The following views are the sums of the measures tagged by kind, namespace
+// and backend.
+var (
+	LookupKeysView         = sumView(LookupKeys)
+	HitsView               = sumView(Hits)
+	MissesView             = sumView(Misses)
+	FillsView              = sumView(Fills)
+	FillBytesView          = sumView(FillBytes)
+	InvalidationsView      = sumView(Invalidations)
+	InvalidationErrorsView = sumView(InvalidationErrors)
+	SkipsView              = sumView(Skips)
+	RefreshesView          = sumView(Refreshes)
+	CoalescedView          = sumView(Coalesced)
+)
+
+// DefaultViews are the default views provided by this package.
+var DefaultViews = []*view.View{
+	LookupKeysView,
+	HitsView,
+	MissesView,
+	FillsView,
+	FillBytesView,
+	InvalidationsView,
+	InvalidationErrorsView,
+	SkipsView,
+	RefreshesView,
+	CoalescedView,
+}
+
+func sumView(m *stats.Int64Measure) *view.View {
+	return &view.View{
+		Name:        m.Name(),
+		Description: m.Description(),
+		Measure:     m,
+		TagKeys:     []tag.Key{KeyKind, KeyNamespace, KeyBackend},
+		Aggregation: view.Sum(),
+	}
+}
+
+// recorder records the measures of the backend.
+type recorder struct {
+	backend string
+}
+
+type partition struct {
+	namespace, kind string
+}
+
+// recordKeys records the number of the keys for each kind and namespace.
+func (r recorder) recordKeys(ctx context.Context, m *stats.Int64Measure, keys []*datastorepb.Key) {
+	if len(keys) == 0 {
+		return
+	}
+	counts := make(map[partition]int64)
+	for _, k := range keys {
+		ns, kind := keyPolicyArgs(k)
+		counts[partition{namespace: ns, kind: kind}]++
+	}
+	for p, n := range counts {
+		r.record(ctx, p, m.M(n))
+	}
+}
+
+// recordFills records the number of the items and the total bytes of them for
+// each kind and namespace.
+func (r recorder) recordFills(ctx context.Context, items []*Item) {
+	if len(items) == 0 {
+		return
+	}
+	type fill struct {
+		n, bytes int64
+	}
+	fills := make(map[partition]*fill)
+	for _, v := range items {
+		ns, kind := keyPolicyArgs(v.Key)
+		p := partition{namespace: ns, kind: kind}
+		f, ok := fills[p]
+		if !ok {
+			f = &fill{}
+			fills[p] = f
+		}
+		f.n++
+		f.bytes += int64(len(v.Value))
+	}
+	for p, f := range fills {
+		r.record(ctx, p, Fills.M(f.n), FillBytes.M(f.bytes))
+	}
+}
+
+func (r recorder) record(ctx context.Context, p partition, ms ...stats.Measurement) {
+	// The measurements are dropped if the kind or the namespace is not a
+	// valid tag value.
+	stats.RecordWithTags(ctx, []tag.Mutator{
+		tag.Upsert(KeyKind, p.kind),
+		tag.Upsert(KeyNamespace, p.namespace),
+		tag.Upsert(KeyBackend, r.backend),
+	}, ms...)
+}
@@ -0,0 +1,84 @@
+package redis
+
+import (
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// numSlots is the number of hash slots of Redis Cluster.
+const numSlots = 16384
+
+// hashSlot returns the hash slot of the key in Redis Cluster. If the key
+// contains a hash tag, only the hash tag is hashed.
+func hashSlot(key string) int {
+	if s := strings.IndexByte(key, '{'); s >= 0 {
+		if e := strings.IndexByte(key[s+1:], '}'); e > 0 {
+			key = key[s+1 : s+1+e]
+		}
+	}
+	return int(crc16(key)) % numSlots
+}
+
+// crc16 returns the CRC16-CCITT (XMODEM) checksum used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// batches splits the indexes of the keys into the batches that can be sent to
+// the client by a multi-key command such as MGET and DEL.
+//
+// The keys for redis.ClusterClient are split by hash slot. The keys for
+// redis.Ring are not batched since the shard of a key is not exposed, and the
+// single-key commands are sent to each shard by a pipeline. The keys for the
+// other clients are sent by a single command.
+func batches(client redis.UniversalClient, keys []string) [][]int {
+	switch client.(type) {
+	case *redis.ClusterClient:
+		var ret [][]int
+		slots := make(map[int]int)
+		for i, k := range keys {
+			s := hashSlot(k)
+			b, ok := slots[s]
+			if !ok {
+				b = len(ret)
+				slots[s] = b
+				ret = append(ret, nil)
+			}
+			ret[b] = append(ret[b], i)
+		}
+		return ret
+	case *redis.Ring:
+		ret := make([][]int, len(keys))
+		for i := range keys {
+			ret[i] = []int{i}
+		}
+		return ret
+	}
+
+	all := make([]int, len(keys))
+	for i := range keys {
+		all[i] = i
+	}
+	return [][]int{all}
+}
+
+// batchKeys returns the keys at the indexes of the batch.
+func batchKeys(keys []string, batch []int) []string {
+	ret := make([]string, len(batch))
+	for i, j := range batch {
+		ret[i] = keys[j]
+	}
+	return ret
+}
@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-redis/redis"
+)
+
+func TestHashSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{key: "123456789", want: 12739},
+		{key: "foo", want: 12182},
+		{key: "bar", want: 5061},
+		{key: "{user1000}.following", want: hashSlot("user1000")},
+		{key: "foo{}{bar}", want: int(crc16("foo{}{bar}")) % numSlots},
+		{key: "foo{{bar}}", want: int(crc16("{bar")) % numSlots},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			if got := hashSlot(tt.key); got != tt.want {
+				t.Errorf("hashSlot() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatches(t *testing.T) {
+	keys := []string{"foo", "bar", "{foo}1", "{bar}2"}
+	tests := []struct {
+		name   string
+		client redis.UniversalClient
+		want   [][]int
+	}{
+		{
+			name:   "client",
+			client: redis.NewClient(&redis.Options{}),
+			want:   [][]int{{0, 1, 2, 3}},
+		},
+		{
+			name:   "cluster",
+			client: redis.NewClusterClient(&redis.ClusterOptions{}),
+			want:   [][]int{{0, 2}, {1, 3}},
+		},
+		{
+			name:   "ring",
+			client: redis.NewRing(&redis.RingOptions{}),
+			want:   [][]int{{0}, {1}, {2}, {3}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer tt.client.Close()
+
+			if got := batches(tt.client, keys); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("batches() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
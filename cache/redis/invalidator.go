@@ -0,0 +1,299 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cachekey"
+	"github.com/go-redis/redis"
+	"go.opencensus.io/trace"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+const (
+	// healthCheckInterval is the interval of pings to detect the broken
+	// subscription.
+	healthCheckInterval = 30 * time.Second
+
+	// maxRetryBackoff is the maximum interval of retrying to receive messages.
+	maxRetryBackoff = 5 * time.Second
+
+	// publisherExpiration is the expiration of the sequence numbers of the
+	// publishers that sent no messages.
+	publisherExpiration = 1 * time.Hour
+)
+
+// ErrAlreadyRunning is returned by Run when the Invalidator is already
+// running.
+var ErrAlreadyRunning = errors.New("redis: Invalidator is already running")
+
+// LocalCache is the interface implemented by an in-process cache invalidated
+// by Invalidator, such as memory.Cache and memory.ShardedCache.
+type LocalCache interface {
+	cache.Cacher
+	cache.Locker
+
+	// Flush deletes all values, leases and locks.
+	Flush()
+}
+
+// Invalidator is an implementation of cache.Cacher and cache.Locker that
+// deletes the values of the LocalCache in all processes. DeleteMulti publishes
+// the keys on a Redis channel, and Run of each process deletes the published
+// keys from its LocalCache. Leases and locks are acquired in the LocalCache.
+//
+// The local caches are flushed when the subscriptions are reconnected or the
+// messages from a process are lost, since the keys published in the meantime
+// are unknown.
+type Invalidator struct {
+	local   LocalCache
+	client  redis.UniversalClient
+	channel string
+	id      string
+
+	// mu serializes the publications so that the sequence numbers are
+	// received in order.
+	mu  sync.Mutex
+	seq uint64
+
+	// running is 1 while Run is running. publishers and pruned are used
+	// only by Run.
+	running    int32
+	publishers map[string]*publisher
+	pruned     time.Time
+}
+
+// publisher is the state of the messages received from a process.
+type publisher struct {
+	seq  uint64
+	seen time.Time
+}
+
+// NewInvalidator returns a new Invalidator of the local cache that uses the
+// channel of the client.
+func NewInvalidator(local LocalCache, client redis.UniversalClient, channel string) (*Invalidator, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	return &Invalidator{
+		local:      local,
+		client:     client,
+		channel:    channel,
+		id:         hex.EncodeToString(b[:]),
+		publishers: make(map[string]*publisher),
+	}, nil
+}
+
+// GetMulti returns the values of the LocalCache.
+func (i *Invalidator) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	return i.local.GetMulti(ctx, keys)
+}
+
+// SetMulti saves the values to the LocalCache.
+func (i *Invalidator) SetMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) {
+	i.local.SetMulti(ctx, keys, values)
+}
+
+// SetItems saves the items to the LocalCache.
+func (i *Invalidator) SetItems(ctx context.Context, items []*cache.Item) error {
+	return i.local.SetItems(ctx, items)
+}
+
+// LeaseMulti acquires leases for the given keys in the LocalCache.
+func (i *Invalidator) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	return i.local.LeaseMulti(ctx, keys)
+}
+
+// LockMulti locks the given keys in the LocalCache. The keys are not locked
+// in the other processes, and are deleted from them by DeleteMulti.
+func (i *Invalidator) LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error {
+	return i.local.LockMulti(ctx, keys, expiration)
+}
+
+// DeleteMulti deletes the values from the LocalCache, and publishes the keys
+// to delete them from the LocalCaches of the other processes. It returns the
+// error of the publication.
+func (i *Invalidator) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/redis.Invalidator.DeleteMulti")
+	defer func() { span.End() }()
+
+	if err := i.local.DeleteMulti(ctx, keys); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.seq++
+	return i.client.Publish(i.channel, encodeMessage(i.id, i.seq, keys)).Err()
+}
+
+// Run receives the published keys and deletes them from the LocalCache until
+// the context is done. It reconnects to Redis when the connection is lost.
+// It returns the error of the context, or ErrAlreadyRunning if Run has been
+// called and has not returned.
+func (i *Invalidator) Run(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt32(&i.running, 0, 1) {
+		return ErrAlreadyRunning
+	}
+	defer atomic.StoreInt32(&i.running, 0)
+
+	pubsub := i.client.Subscribe(i.channel)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		// Receive returns an error when it is closed.
+		pubsub.Close()
+	}()
+
+	subscribed := false
+	for attempt := 0; ; {
+		msg, err := pubsub.ReceiveTimeout(healthCheckInterval)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				// Check the connection. If it's broken, the error is returned
+				// by the next ReceiveTimeout.
+				pubsub.Ping()
+				continue
+			}
+
+			// The subscription is renewed by the next ReceiveTimeout. The
+			// messages may be lost in the meantime.
+			i.local.Flush()
+			attempt++
+			if err := sleep(ctx, retryBackoff(attempt)); err != nil {
+				return err
+			}
+			continue
+		}
+		attempt = 0
+
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				if subscribed {
+					// Reconnected.
+					i.local.Flush()
+				}
+				subscribed = true
+			}
+		case *redis.Message:
+			i.receive(ctx, msg.Payload)
+		}
+	}
+}
+
+// receive deletes the keys of the message from the LocalCache. The LocalCache
+// is flushed if the preceding messages of the publisher are lost.
+func (i *Invalidator) receive(ctx context.Context, payload string) {
+	id, seq, keys, err := decodeMessage(payload)
+	if err != nil {
+		i.local.Flush()
+		return
+	}
+	if id == i.id {
+		// Already deleted by DeleteMulti.
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(i.pruned) > publisherExpiration {
+		for k, v := range i.publishers {
+			if now.Sub(v.seen) > publisherExpiration {
+				delete(i.publishers, k)
+			}
+		}
+		i.pruned = now
+	}
+
+	p, ok := i.publishers[id]
+	if !ok {
+		p = &publisher{}
+		i.publishers[id] = p
+	} else if seq != p.seq+1 {
+		i.local.Flush()
+	}
+	p.seq = seq
+	p.seen = now
+
+	i.local.DeleteMulti(ctx, keys)
+}
+
+// encodeMessage encodes the ID of the publisher, the sequence number and the
+// keys separated by newlines.
+func encodeMessage(id string, seq uint64, keys []*datastorepb.Key) string {
+	var b strings.Builder
+	b.WriteString(id)
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatUint(seq, 10))
+	for _, k := range keys {
+		b.WriteByte('\n')
+		b.WriteString(cachekey.Encode(k))
+	}
+	return b.String()
+}
+
+// decodeMessage decodes the message encoded by encodeMessage.
+func decodeMessage(s string) (id string, seq uint64, keys []*datastorepb.Key, err error) {
+	lines := strings.Split(s, "\n")
+	header := strings.SplitN(lines[0], " ", 2)
+	if len(header) != 2 {
+		return "", 0, nil, fmt.Errorf("redis: invalid invalidation message %q", lines[0])
+	}
+	seq, err = strconv.ParseUint(header[1], 10, 64)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	keys = make([]*datastorepb.Key, len(lines)-1)
+	for j, v := range lines[1:] {
+		if keys[j], err = cachekey.Decode(v); err != nil {
+			return "", 0, nil, err
+		}
+	}
+	return header[0], seq, keys, nil
+}
+
+// retryBackoff returns the exponential backoff of the attempt.
+func retryBackoff(attempt int) time.Duration {
+	d := 100 * time.Millisecond
+	for j := 1; j < attempt && d < maxRetryBackoff; j++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,196 @@
+package redis
+
+import (
+	"context"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/memory"
+	"github.com/go-redis/redis"
+	"github.com/golang/protobuf/proto"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+var invalidatorKeys = []*datastorepb.Key{
+	{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+	{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Name{Name: "a\nb"}}}},
+	{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 3}}}},
+}
+
+func TestMessage(t *testing.T) {
+	id, seq, keys, err := decodeMessage(encodeMessage("p", 42, invalidatorKeys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "p" || seq != 42 {
+		t.Errorf("decodeMessage() = %q, %d, want %q, %d", id, seq, "p", 42)
+	}
+	if len(keys) != len(invalidatorKeys) {
+		t.Fatalf("decodeMessage() = %v, want %v", keys, invalidatorKeys)
+	}
+	for i, k := range keys {
+		if !proto.Equal(k, invalidatorKeys[i]) {
+			t.Errorf("decodeMessage()[%d] = %v, want %v", i, k, invalidatorKeys[i])
+		}
+	}
+
+	for _, s := range []string{"", "p", "p x", "p 1\n!"} {
+		if _, _, _, err := decodeMessage(s); err == nil {
+			t.Errorf("decodeMessage(%q) error = nil, want an error", s)
+		}
+	}
+}
+
+func TestInvalidator_receive(t *testing.T) {
+	local := memory.NewCache(cache.Expiration{})
+	i, err := NewInvalidator(local, redis.NewClient(&redis.Options{}), "invalidation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	reset := func() {
+		local.SetMulti(ctx, invalidatorKeys, [][]byte{{'a'}, {'b'}, {'c'}})
+	}
+
+	reset()
+	i.receive(ctx, encodeMessage(i.id, 1, invalidatorKeys[:1]))
+	if got, want := local.GetMulti(ctx, invalidatorKeys), [][]byte{{'a'}, {'b'}, {'c'}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("own message: LocalCache = %v, want %v", got, want)
+	}
+
+	i.receive(ctx, encodeMessage("p", 5, invalidatorKeys[:1]))
+	i.receive(ctx, encodeMessage("p", 6, invalidatorKeys[1:2]))
+	if got, want := local.GetMulti(ctx, invalidatorKeys), [][]byte{nil, nil, {'c'}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("sequential messages: LocalCache = %v, want %v", got, want)
+	}
+
+	reset()
+	i.receive(ctx, encodeMessage("p", 8, invalidatorKeys[:1]))
+	if got, want := local.GetMulti(ctx, invalidatorKeys), [][]byte{nil, nil, nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("lost message: LocalCache = %v, want %v", got, want)
+	}
+
+	reset()
+	i.receive(ctx, "invalid")
+	if got, want := local.GetMulti(ctx, invalidatorKeys), [][]byte{nil, nil, nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("invalid message: LocalCache = %v, want %v", got, want)
+	}
+}
+
+func TestInvalidator_Locker(t *testing.T) {
+	local := memory.NewCache(cache.Expiration{})
+	i, err := NewInvalidator(local, redis.NewClient(&redis.Options{}), "invalidation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	var _ cache.Locker = i
+	leases, err := i.LeaseMulti(ctx, invalidatorKeys[:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.LockMulti(ctx, invalidatorKeys[1:2], 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.SetItems(ctx, []*cache.Item{
+		{Key: invalidatorKeys[0], Value: []byte{'a'}, Lease: leases[0]},
+		{Key: invalidatorKeys[1], Value: []byte{'b'}, Lease: leases[1]},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := local.GetMulti(ctx, invalidatorKeys[:2]), [][]byte{{'a'}, nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("LocalCache = %v, want %v", got, want)
+	}
+}
+
+func TestInvalidator_RunTwice(t *testing.T) {
+	// The server is unreachable, and Run keeps retrying until canceled.
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	defer client.Close()
+	i, err := NewInvalidator(memory.NewCache(cache.Expiration{}), client, "invalidation")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- i.Run(ctx) }()
+	for atomic.LoadInt32(&i.running) == 0 {
+		time.Sleep(1 * time.Millisecond)
+	}
+
+	if err := i.Run(ctx); err != ErrAlreadyRunning {
+		t.Errorf("Invalidator.Run() error = %v, want %v", err, ErrAlreadyRunning)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Invalidator.Run() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestInvalidator(t *testing.T) {
+	client := redis.NewClient(&redis.Options{})
+	defer client.Close()
+	if err := client.FlushAll().Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local1 := memory.NewCache(cache.Expiration{})
+	local2 := memory.NewCache(cache.Expiration{})
+	i1, err := NewInvalidator(local1, client, "invalidation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i2, err := NewInvalidator(local2, client, "invalidation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- i2.Run(ctx) }()
+
+	// Wait for the subscription.
+	for {
+		n, err := client.PubSubNumSub("invalidation").Result()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n["invalidation"] > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	i1.SetMulti(ctx, invalidatorKeys, [][]byte{{'a'}, {'b'}, {'c'}})
+	i2.SetMulti(ctx, invalidatorKeys, [][]byte{{'a'}, {'b'}, {'c'}})
+	if err := i1.DeleteMulti(ctx, invalidatorKeys[:2]); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]byte{nil, nil, {'c'}}
+	if got := i1.GetMulti(ctx, invalidatorKeys); !reflect.DeepEqual(got, want) {
+		t.Errorf("Invalidator.GetMulti() = %v, want %v", got, want)
+	}
+	deadline := time.Now().Add(1 * time.Second)
+	for {
+		got := i2.GetMulti(ctx, invalidatorKeys)
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Invalidator.GetMulti() of the other process = %v, want %v", got, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Invalidator.Run() error = %v, want %v", err, context.Canceled)
+	}
+}
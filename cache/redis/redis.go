@@ -1,31 +1,81 @@
 /*
 Package redis provides Redis cache that implements cache.Cacher interface.
+
+The Cache can use a standalone Redis, Redis Sentinel, Redis Cluster or
+consistent hashing over multiple Redis servers by redis.Client created by
+redis.NewClient or redis.NewFailoverClient, redis.ClusterClient or redis.Ring.
+The keys of GetMulti and DeleteMulti are split by hash slot for Redis Cluster
+and by shard for redis.Ring, and the results are merged transparently.
+
+Invalidator deletes the values of an in-process cache, such as memory.Cache,
+in all processes by Redis Pub/Sub.
 */
 package redis
 
 import (
 	"context"
-	"strconv"
-	"strings"
 	"time"
 
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cacheitem"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cachekey"
 	"github.com/go-redis/redis"
 	"go.opencensus.io/trace"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 )
 
-// Cache is an implementation of cache.Cacher by Redis.
+// setItemScript sets the value only if the lease in ARGV[1] is held. Without a
+// lease, it sets the value only if the key has neither a lease nor a lock, and
+// the cached value does not have a newer version than ARGV[4], which is empty
+// for a value without a version. If ARGV[5] is "1", it sets the value only if
+// the key has a cached value. The values are
+// encoded by cacheitem.
+var setItemScript = redis.NewScript(`
+local cur = redis.call("GET", KEYS[1])
+if ARGV[1] ~= "" then
+	if cur ~= ARGV[1] then
+		return 0
+	end
+elseif cur and string.sub(cur, 1, 2) == "\255L" then
+	return 0
+elseif not cur and ARGV[5] == "1" then
+	return 0
+elseif cur and ARGV[4] ~= "" and string.sub(cur, 1, 2) == "\255V" then
+	if string.sub(cur, 3, 22) > ARGV[4] then
+		return 0
+	end
+end
+if ARGV[3] == "0" then
+	redis.call("SET", KEYS[1], ARGV[2])
+else
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+end
+return 1
+`)
+
+// Cache is an implementation of cache.Cacher, cache.ErrorCacher and
+// cache.Locker by Redis.
 type Cache struct {
-	expiration time.Duration
-	client     *redis.Client
+	expiration cache.Expiration
+	client     redis.UniversalClient
+	keys       *cachekey.Encoder
+}
+
+// NewCache returns a new Cache with given expiration. If set to the zero
+// value, each item has no expiration time. The keys are encoded by cachekey.Encoder with the
+// given options.
+func NewCache(expiration cache.Expiration, client *redis.Client, opts ...cachekey.Option) *Cache {
+	return NewUniversalCache(expiration, client, opts...)
 }
 
-// NewCache returns a new Cache with given expiration. If set to 0, each item
-// has no expiration time.
-func NewCache(expiration time.Duration, client *redis.Client) *Cache {
+// NewUniversalCache is the same as NewCache except that it accepts any client
+// returned by redis.NewUniversalClient, such as redis.ClusterClient and
+// redis.Ring as well as redis.Client.
+func NewUniversalCache(expiration cache.Expiration, client redis.UniversalClient, opts ...cachekey.Option) *Cache {
 	return &Cache{
 		expiration: expiration,
 		client:     client,
+		keys:       cachekey.NewEncoder(opts...),
 	}
 }
 
@@ -35,23 +85,61 @@ func (c *Cache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte
 	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/redis.GetMulti")
 	defer func() { span.End() }()
 
-	key := make([]string, len(keys))
-	for i, k := range keys {
-		key[i] = keystr(k)
-	}
+	ret, _ := c.getMulti(ctx, keys)
+	return ret
+}
+
+// GetMultiWithError is the same as GetMulti except that it returns the error
+// of Redis.
+func (c *Cache) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/redis.GetMultiWithError")
+	defer func() { span.End() }()
 
-	values, err := c.client.MGet(key...).Result()
+	return c.getMulti(ctx, keys)
+}
+
+func (c *Cache) getMulti(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	key := c.encodeKeys(keys)
+	values, err := c.mget(key)
 	if err != nil {
-		return nil
+		return nil, err
 	}
 
 	ret := make([][]byte, len(values))
 	for i, v := range values {
-		if v != nil {
-			ret[i] = []byte(v.(string))
+		if v == nil {
+			continue
 		}
+		// A lease is missing.
+		ret[i] = cacheitem.Value([]byte(v.(string)))
 	}
-	return ret
+	return ret, nil
+}
+
+// mget returns the values of the keys by MGET for each batch.
+func (c *Cache) mget(key []string) ([]interface{}, error) {
+	bs := batches(c.client, key)
+	if len(bs) == 1 {
+		return c.client.MGet(key...).Result()
+	}
+
+	cmds := make([]*redis.SliceCmd, len(bs))
+	if _, err := c.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, b := range bs {
+			cmds[i] = pipe.MGet(batchKeys(key, b)...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, len(key))
+	for i, b := range bs {
+		for j, v := range cmds[i].Val() {
+			values[b[j]] = v
+		}
+	}
+	return values, nil
 }
 
 // SetMulti sets the given keys and values to items.
@@ -59,12 +147,26 @@ func (c *Cache) SetMulti(ctx context.Context, keys []*datastorepb.Key, values []
 	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/redis.SetMulti")
 	defer func() { span.End() }()
 
-	c.client.Pipelined(func(pipe redis.Pipeliner) error {
+	c.setMulti(ctx, keys, values)
+}
+
+// SetMultiWithError is the same as SetMulti except that it returns the error
+// of Redis.
+func (c *Cache) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/redis.SetMultiWithError")
+	defer func() { span.End() }()
+
+	return c.setMulti(ctx, keys, values)
+}
+
+func (c *Cache) setMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	_, err := c.client.Pipelined(func(pipe redis.Pipeliner) error {
 		for i, k := range keys {
-			pipe.Set(keystr(k), values[i], c.expiration)
+			pipe.Set(c.keys.Encode(k), values[i], redisExpiration(c.expiration.Next()))
 		}
 		return nil
 	})
+	return err
 }
 
 // DeleteMulti deletes items for the given keys.
@@ -72,30 +174,116 @@ func (c *Cache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error
 	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/redis.DeleteMulti")
 	defer func() { span.End() }()
 
+	key := c.encodeKeys(keys)
+	bs := batches(c.client, key)
+	if len(bs) == 1 {
+		return c.client.Del(key...).Err()
+	}
+
+	_, err := c.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, b := range bs {
+			pipe.Del(batchKeys(key, b)...)
+		}
+		return nil
+	})
+	return err
+}
+
+func (c *Cache) encodeKeys(keys []*datastorepb.Key) []string {
 	key := make([]string, len(keys))
 	for i, k := range keys {
-		key[i] = keystr(k)
+		key[i] = c.keys.Encode(k)
 	}
-	return c.client.Del(key...).Err()
+	return key
 }
 
-func keystr(key *datastorepb.Key) string {
-	path := key.GetPath()
+// LeaseMulti acquires leases for the given keys that have neither an item nor
+// a lease.
+func (c *Cache) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/redis.LeaseMulti")
+	defer func() { span.End() }()
 
-	s := make([]string, 0, len(path)*2+1)
-	if ns := key.GetPartitionId().GetNamespaceId(); ns != "" {
-		s = append(s, ns)
-	} else {
-		s = append(s, "[default]")
+	leases := make([]uint64, len(keys))
+	cmds := make([]*redis.BoolCmd, len(keys))
+	if _, err := c.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			l, err := cacheitem.NewLease()
+			if err != nil {
+				return err
+			}
+			leases[i] = l
+			cmds[i] = pipe.SetNX(c.keys.Encode(k), cacheitem.Lease(l), cacheitem.LeaseExpiration)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for i, cmd := range cmds {
+		if !cmd.Val() {
+			leases[i] = 0
+		}
 	}
-	for _, p := range path {
-		s = append(s, p.GetKind())
-		switch p.GetIdType().(type) {
-		case *datastorepb.Key_PathElement_Id:
-			s = append(s, strconv.FormatInt(p.GetId(), 10))
-		case *datastorepb.Key_PathElement_Name:
-			s = append(s, strconv.Quote(p.GetName()))
+	return leases, nil
+}
+
+// SetItems sets the given items. An item with a lease is set only if the lease
+// is held, and an item without a lease is not set if the key has a lease or a
+// lock, or the item has a newer version. An item with Replace is set only if
+// the key has an item.
+func (c *Cache) SetItems(ctx context.Context, items []*cache.Item) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/redis.SetItems")
+	defer func() { span.End() }()
+
+	_, err := c.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, v := range items {
+			expiration := v.Expiration
+			if expiration == 0 {
+				expiration = c.expiration.Next()
+			}
+			var lease, version, replace string
+			value := v.Value
+			if v.Lease != 0 {
+				lease = string(cacheitem.Lease(v.Lease))
+			}
+			if v.Version != 0 {
+				version = cacheitem.FormatVersion(v.Version)
+				value = cacheitem.Versioned(v.Version, v.Value)
+			}
+			if v.Replace {
+				replace = "1"
+			}
+			setItemScript.Eval(pipe, []string{c.keys.Encode(v.Key)}, lease, value, int64(redisExpiration(expiration)/time.Millisecond), version, replace)
 		}
+		return nil
+	})
+	return err
+}
+
+// LockMulti locks the given keys until the expiration.
+func (c *Cache) LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error {
+	_, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/redis.LockMulti")
+	defer func() { span.End() }()
+
+	_, err := c.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, k := range keys {
+			// A lock is a lease that is never held by anyone.
+			l, err := cacheitem.NewLease()
+			if err != nil {
+				return err
+			}
+			pipe.Set(c.keys.Encode(k), cacheitem.Lease(l), redisExpiration(expiration))
+		}
+		return nil
+	})
+	return err
+}
+
+// redisExpiration rounds up a positive expiration shorter than 1ms, the
+// resolution of Redis, to 1ms since 0 means no expiration.
+func redisExpiration(expiration time.Duration) time.Duration {
+	if expiration > 0 && expiration < time.Millisecond {
+		return time.Millisecond
 	}
-	return strings.Join(s, "/")
+	return expiration
 }
@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/cacheitem"
 	"github.com/go-redis/redis"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 )
@@ -31,7 +33,7 @@ func TestCache_GetMulti(t *testing.T) {
 			fields: fields{
 				expiration: 1 * time.Hour,
 				items: map[string][]byte{
-					"[default]/k/1": {'a'},
+					"v1///k/i1": {'a'},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -46,8 +48,8 @@ func TestCache_GetMulti(t *testing.T) {
 			fields: fields{
 				expiration: 1 * time.Hour,
 				items: map[string][]byte{
-					"[default]/k/1": {'a'},
-					"[default]/k/2": {'b'},
+					"v1///k/i1": {'a'},
+					"v1///k/i2": {'b'},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -78,8 +80,8 @@ func TestCache_GetMulti(t *testing.T) {
 			fields: fields{
 				expiration: minExp,
 				items: map[string][]byte{
-					"[default]/k/1": {'a'},
-					"[default]/k/2": {'b'},
+					"v1///k/i1": {'a'},
+					"v1///k/i2": {'b'},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -96,7 +98,7 @@ func TestCache_GetMulti(t *testing.T) {
 			name: "1 found 1 not found",
 			fields: fields{
 				items: map[string][]byte{
-					"[default]/k/2": {'b'},
+					"v1///k/i2": {'b'},
 				},
 			},
 			args: args{keys: []*datastorepb.Key{
@@ -127,7 +129,7 @@ func TestCache_GetMulti(t *testing.T) {
 				time.Sleep(minExp)
 			}
 
-			c := NewCache(tt.fields.expiration, client)
+			c := NewCache(cache.TTL(tt.fields.expiration), client)
 			if got := c.GetMulti(context.Background(), tt.args.keys); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("Cache.GetMulti() = %v, want %v", got, tt.want)
 			}
@@ -175,7 +177,7 @@ func TestCache_SetMulti(t *testing.T) {
 			client := redis.NewClient(&redis.Options{})
 			defer client.FlushDB()
 
-			c := NewCache(0, client)
+			c := NewCache(cache.Expiration{}, client)
 			c.SetMulti(context.Background(), tt.args.keys, tt.args.values)
 			got, err := client.Keys("*").Result()
 			if err != nil {
@@ -205,8 +207,8 @@ func TestCache_DeleteMulti(t *testing.T) {
 		{
 			name: "1 item",
 			fields: fields{items: map[string][]byte{
-				"[default]/k/1": {'a'},
-				"[default]/k/2": {'b'},
+				"v1///k/i1": {'a'},
+				"v1///k/i2": {'b'},
 			}},
 			args: args{keys: []*datastorepb.Key{
 				{
@@ -218,8 +220,8 @@ func TestCache_DeleteMulti(t *testing.T) {
 		{
 			name: "2 items",
 			fields: fields{items: map[string][]byte{
-				"[default]/k/1": {'a'},
-				"[default]/k/2": {'b'},
+				"v1///k/i1": {'a'},
+				"v1///k/i2": {'b'},
 			}},
 			args: args{keys: []*datastorepb.Key{
 				{
@@ -234,7 +236,7 @@ func TestCache_DeleteMulti(t *testing.T) {
 		{
 			name: "not found",
 			fields: fields{items: map[string][]byte{
-				"[default]/k/2": {'b'},
+				"v1///k/i2": {'b'},
 			}},
 			args: args{keys: []*datastorepb.Key{
 				{
@@ -258,7 +260,7 @@ func TestCache_DeleteMulti(t *testing.T) {
 				t.Fatal(err)
 			}
 
-			c := NewCache(0, client)
+			c := NewCache(cache.Expiration{}, client)
 			if err := c.DeleteMulti(context.Background(), tt.args.keys); (err != nil) != tt.wantErr {
 				t.Errorf("Cache.DeleteMulti() error = %v, wantErr %v", err, tt.wantErr)
 			}
@@ -273,39 +275,395 @@ func TestCache_DeleteMulti(t *testing.T) {
 	}
 }
 
-func Test_keystr(t *testing.T) {
+func TestCache_LeaseMulti(t *testing.T) {
+	type fields struct {
+		items map[string][]byte
+	}
 	type args struct {
-		key *datastorepb.Key
+		keys []*datastorepb.Key
 	}
 	tests := []struct {
-		name string
-		args args
-		want string
+		name   string
+		fields fields
+		args   args
+		want   []bool
 	}{
 		{
-			name: "id",
-			args: args{key: &datastorepb.Key{
-				Path: []*datastorepb.Key_PathElement{
-					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Id{Id: 1}},
+			name: "not found",
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+				},
+			}},
+			want: []bool{true, true},
+		},
+		{
+			name: "1 found 1 not found",
+			fields: fields{items: map[string][]byte{
+				"v1///k/i1": {'a'},
+			}},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+				},
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
 				},
 			}},
-			want: `[default]/kind/1`,
+			want: []bool{false, true},
 		},
 		{
-			name: "name",
-			args: args{key: &datastorepb.Key{
-				Path: []*datastorepb.Key_PathElement{
-					{Kind: "kind", IdType: &datastorepb.Key_PathElement_Name{Name: "name"}},
+			name: "leased",
+			fields: fields{items: map[string][]byte{
+				"v1///k/i1": cacheitem.Lease(1),
+			}},
+			args: args{keys: []*datastorepb.Key{
+				{
+					Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
 				},
 			}},
-			want: `[default]/kind/"name"`,
+			want: []bool{false},
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := keystr(tt.args.key); got != tt.want {
-				t.Errorf("keystr() = %v, want %v", got, tt.want)
+			client := redis.NewClient(&redis.Options{})
+			defer client.FlushDB()
+
+			if _, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+				for k, v := range tt.fields.items {
+					pipe.Set(k, v, 0)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			c := NewCache(cache.Expiration{}, client)
+			leases, err := c.LeaseMulti(context.Background(), tt.args.keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]bool, len(leases))
+			for i, l := range leases {
+				got[i] = l != 0
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cache.LeaseMulti() = %v, want acquired %v", leases, tt.want)
+			}
+			for i, v := range c.GetMulti(context.Background(), tt.args.keys) {
+				if tt.want[i] && v != nil {
+					t.Errorf("Cache.GetMulti() = %v, want leased key to be missing", v)
+				}
 			}
 		})
 	}
 }
+
+func TestCache_SetItems(t *testing.T) {
+	type fields struct {
+		items map[string][]byte
+	}
+	type args struct {
+		items []*cache.Item
+	}
+	tests := []struct {
+		name   string
+		fields fields
+		args   args
+		want   [][]byte
+	}{
+		{
+			name: "without lease",
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+				},
+			}},
+			want: [][]byte{{'a'}},
+		},
+		{
+			name: "lease held",
+			fields: fields{items: map[string][]byte{
+				"v1///k/i1": cacheitem.Lease(1),
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+					Lease: 1,
+				},
+			}},
+			want: [][]byte{{'a'}},
+		},
+		{
+			name: "lease released",
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+					Lease: 1,
+				},
+			}},
+			want: [][]byte{nil},
+		},
+		{
+			name: "lease taken over",
+			fields: fields{items: map[string][]byte{
+				"v1///k/i1": cacheitem.Lease(2),
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+					Lease: 1,
+				},
+			}},
+			want: [][]byte{nil},
+		},
+		{
+			name: "leased by others",
+			fields: fields{items: map[string][]byte{
+				"v1///k/i1": cacheitem.Lease(2),
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'a'},
+				},
+			}},
+			want: [][]byte{nil},
+		},
+		{
+			name: "newer version",
+			fields: fields{items: map[string][]byte{
+				"v1///k/i1": cacheitem.Versioned(1, []byte{'a'}),
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'b'},
+					Version: 2,
+				},
+			}},
+			want: [][]byte{{'b'}},
+		},
+		{
+			name: "older version",
+			fields: fields{items: map[string][]byte{
+				"v1///k/i1": cacheitem.Versioned(2, []byte{'a'}),
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'b'},
+					Version: 1,
+				},
+			}},
+			want: [][]byte{{'a'}},
+		},
+		{
+			name: "without version",
+			fields: fields{items: map[string][]byte{
+				"v1///k/i1": cacheitem.Versioned(2, []byte{'a'}),
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value: []byte{'b'},
+				},
+			}},
+			want: [][]byte{{'b'}},
+		},
+		{
+			name: "replace",
+			fields: fields{items: map[string][]byte{
+				"v1///k/i1": []byte{'a'},
+			}},
+			args: args{items: []*cache.Item{
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+					},
+					Value:   []byte{'b'},
+					Replace: true,
+				},
+				{
+					Key: &datastorepb.Key{
+						Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+					},
+					Value:   []byte{'c'},
+					Replace: true,
+				},
+			}},
+			want: [][]byte{{'b'}, nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := redis.NewClient(&redis.Options{})
+			defer client.FlushDB()
+
+			if _, err := client.Pipelined(func(pipe redis.Pipeliner) error {
+				for k, v := range tt.fields.items {
+					pipe.Set(k, v, 0)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			c := NewCache(cache.Expiration{}, client)
+			if err := c.SetItems(context.Background(), tt.args.items); err != nil {
+				t.Fatal(err)
+			}
+			keys := make([]*datastorepb.Key, len(tt.args.items))
+			for i, v := range tt.args.items {
+				keys[i] = v.Key
+			}
+			if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Cache.GetMulti() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCache_SetItemsWithShortExpiration(t *testing.T) {
+	key := &datastorepb.Key{
+		Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+	}
+
+	client := redis.NewClient(&redis.Options{})
+	defer client.FlushDB()
+
+	c := NewCache(cache.Expiration{}, client)
+	if err := c.SetItems(context.Background(), []*cache.Item{{Key: key, Value: []byte{'a'}, Expiration: 1 * time.Nanosecond}}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if got := c.GetMulti(context.Background(), []*datastorepb.Key{key}); !reflect.DeepEqual(got, [][]byte{nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want the item to be expired", got)
+	}
+}
+
+func TestCache_LockMulti(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+		},
+	}
+
+	client := redis.NewClient(&redis.Options{})
+	defer client.FlushDB()
+
+	if err := client.Set("v1///k/i1", []byte{'a'}, 0).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCache(cache.Expiration{}, client)
+	leases, err := c.LeaseMulti(context.Background(), keys[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LockMulti(context.Background(), keys, 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want locked keys to be missing", got)
+	}
+	if got, _ := c.LeaseMulti(context.Background(), keys); !reflect.DeepEqual(got, []uint64{0, 0}) {
+		t.Errorf("Cache.LeaseMulti() = %v, want no leases for locked keys", got)
+	}
+	if err := c.SetItems(context.Background(), []*cache.Item{{Key: keys[1], Value: []byte{'b'}, Lease: leases[0]}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want a lease acquired before locking to be released", got)
+	}
+	if err := c.SetItems(context.Background(), []*cache.Item{{Key: keys[0], Value: []byte{'c'}, Version: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want an item without a lease not to overwrite the lock", got)
+	}
+
+	if err := c.DeleteMulti(context.Background(), keys); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.LeaseMulti(context.Background(), keys); got[0] == 0 || got[1] == 0 {
+		t.Errorf("Cache.LeaseMulti() = %v, want leases for unlocked keys", got)
+	}
+}
+
+func TestCache_GetMultiWithError(t *testing.T) {
+	client := redis.NewClient(&redis.Options{})
+	client.Close()
+
+	c := NewCache(cache.Expiration{}, client)
+	keys := []*datastorepb.Key{
+		{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+	}
+	if _, err := c.GetMultiWithError(context.Background(), keys); err == nil {
+		t.Error("Cache.GetMultiWithError() error = nil, want error of closed client")
+	}
+	if err := c.SetMultiWithError(context.Background(), keys, [][]byte{{'a'}}); err == nil {
+		t.Error("Cache.SetMultiWithError() error = nil, want error of closed client")
+	}
+}
+
+func TestCache_Ring(t *testing.T) {
+	keys := []*datastorepb.Key{
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}},
+		},
+		{
+			Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 3}}},
+		},
+	}
+
+	client := redis.NewRing(&redis.RingOptions{Addrs: map[string]string{"shard1": "localhost:6379"}})
+	defer client.FlushDB()
+	defer client.Close()
+
+	c := NewUniversalCache(cache.Expiration{}, client)
+	if err := c.SetMultiWithError(context.Background(), keys[:2], [][]byte{{'a'}, {'b'}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.GetMultiWithError(context.Background(), keys); err != nil || !reflect.DeepEqual(got, [][]byte{{'a'}, {'b'}, nil}) {
+		t.Errorf("Cache.GetMultiWithError() = %v, %v, want %v", got, err, [][]byte{{'a'}, {'b'}, nil})
+	}
+	if err := c.DeleteMulti(context.Background(), keys); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil, nil}) {
+		t.Errorf("Cache.GetMulti() = %v, want all keys to be deleted", got)
+	}
+}
@@ -0,0 +1,54 @@
+package tiered
+
+import (
+	"context"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// Hits is the measure of the number of keys found in each tier, recorded by
+// GetMulti of the Cache.
+var Hits = stats.Int64("github.com/DeNA/cloud-datastore-interceptor/cache/tiered/hits", "Number of keys found in each tier", stats.UnitDimensionless)
+
+// KeyTier is the tier that served the keys, "l1" or "l2".
+var KeyTier = tag.MustNewKey("tier")
+
+const (
+	tierL1 = "l1"
+	tierL2 = "l2"
+)
+
+// HitsView is the sum of Hits tagged by tier and the kind.
+var HitsView = &view.View{
+	Name:        Hits.Name(),
+	Description: Hits.Description(),
+	Measure:     Hits,
+	TagKeys:     []tag.Key{KeyTier, cache.KeyKind},
+	Aggregation: view.Sum(),
+}
+
+// DefaultViews are the default views provided by this package.
+var DefaultViews = []*view.View{HitsView}
+
+// recordHits records the number of the keys found in the tier for each kind.
+func recordHits(ctx context.Context, tier string, keys []*datastorepb.Key) {
+	counts := make(map[string]int64)
+	for _, k := range keys {
+		var kind string
+		if path := k.GetPath(); len(path) > 0 {
+			kind = path[len(path)-1].GetKind()
+		}
+		counts[kind]++
+	}
+	for kind, n := range counts {
+		// The measurement is dropped if the kind is not a valid tag value.
+		stats.RecordWithTags(ctx, []tag.Mutator{
+			tag.Upsert(KeyTier, tier),
+			tag.Upsert(cache.KeyKind, kind),
+		}, Hits.M(n))
+	}
+}
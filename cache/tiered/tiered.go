@@ -0,0 +1,277 @@
+/*
+Package tiered provides a two-tier cache that implements cache.Cacher
+interface, such as an in-process memory.Cache over a redis.Cache shared by
+processes.
+
+Values are read from the first tier (L1), and the keys missing in L1 are read
+from the second tier (L2). Values found in L2 are saved to L1. Values are saved
+to and deleted from both tiers. Leases and locks are acquired in L2, which is
+shared by the processes.
+
+Since L1 of other processes is not deleted, L1 should have a short expiration
+so that the stale values are not used for long. For the same reason, a value
+found in L2 just before a concurrent DeleteMulti may be saved to L1 after it,
+and is used until it expires in L1. The values saved to L1 from L2 do not have
+the versions of the entities.
+*/
+package tiered
+
+import (
+	"context"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"go.opencensus.io/trace"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// Cache is an implementation of cache.Cacher and cache.ItemSetter by two
+// Cachers.
+type Cache struct {
+	l1, l2       cache.ErrorCacher
+	l1Setter     cache.ItemSetter
+	l2Setter     cache.ItemSetter
+	l1Expiration time.Duration
+	errorHandler cache.ErrorHandler
+}
+
+// Option configures the Cache returned by NewCache.
+type Option func(*Cache)
+
+// WithL1Expiration returns an Option that limits the expiration of the items
+// saved to L1 by SetItems and the values found in L2. If it is not set, L1
+// uses the expiration of the items, or the default expiration of L1.
+func WithL1Expiration(expiration time.Duration) Option {
+	return func(c *Cache) {
+		c.l1Expiration = expiration
+	}
+}
+
+// WithErrorHandler returns an Option that calls the handler when L1 or L2
+// returns an error. The method is prefixed with the tier, e.g. "L2.GetMulti".
+// The errors of GetMulti and SetMulti are reported only if the tier implements
+// cache.ErrorCacher.
+func WithErrorHandler(handler cache.ErrorHandler) Option {
+	return func(c *Cache) {
+		c.errorHandler = handler
+	}
+}
+
+// NewCache returns a new Cache that uses l1 over l2. The expirations and the
+// other configurations of each tier are set by its constructor. The returned
+// Cacher also implements cache.Leaser and cache.Locker if l2 implements them.
+func NewCache(l1, l2 cache.Cacher, opts ...Option) cache.Cacher {
+	c := &Cache{
+		l1: cache.AdaptCacher(l1),
+		l2: cache.AdaptCacher(l2),
+	}
+	c.l1Setter, _ = l1.(cache.ItemSetter)
+	c.l2Setter, _ = l2.(cache.ItemSetter)
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	switch l2 := l2.(type) {
+	case cache.Locker:
+		return &locker{c, l2}
+	case cache.Leaser:
+		return &leaser{c, l2}
+	}
+	return c
+}
+
+func (c *Cache) report(ctx context.Context, method string, err error) {
+	if err != nil && c.errorHandler != nil {
+		c.errorHandler(ctx, method, err)
+	}
+}
+
+// GetMulti returns the values of the given keys from L1, or from L2 if they
+// are missing in L1. The values found in L2 are saved to L1. Errors of L2 are
+// passed to the handler set by WithErrorHandler, and the values found in L1
+// are still returned.
+func (c *Cache) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/tiered.GetMulti")
+	defer func() { span.End() }()
+
+	ret := make([][]byte, len(keys))
+	l1, err := c.l1.GetMultiWithError(ctx, keys)
+	c.report(ctx, "L1.GetMulti", err)
+
+	var missing []*datastorepb.Key
+	var missingIndexes []int
+	var l1Hits []*datastorepb.Key
+	for i, k := range keys {
+		if i < len(l1) && l1[i] != nil {
+			ret[i] = l1[i]
+			l1Hits = append(l1Hits, k)
+			continue
+		}
+		missing = append(missing, k)
+		missingIndexes = append(missingIndexes, i)
+	}
+	recordHits(ctx, tierL1, l1Hits)
+	span.AddAttributes(trace.Int64Attribute("l1_hits", int64(len(l1Hits))))
+	if len(missing) == 0 {
+		return ret
+	}
+
+	l2, err := c.l2.GetMultiWithError(ctx, missing)
+	c.report(ctx, "L2.GetMulti", err)
+
+	var promoted []*cache.Item
+	var l2Hits []*datastorepb.Key
+	for i, v := range l2 {
+		if v == nil {
+			continue
+		}
+		ret[missingIndexes[i]] = v
+		promoted = append(promoted, &cache.Item{Key: missing[i], Value: v})
+		l2Hits = append(l2Hits, missing[i])
+	}
+	recordHits(ctx, tierL2, l2Hits)
+	span.AddAttributes(trace.Int64Attribute("l2_hits", int64(len(l2Hits))))
+
+	if len(promoted) > 0 {
+		c.report(ctx, "L1.SetItems", c.setL1(ctx, promoted))
+	}
+	return ret
+}
+
+// SetMulti saves the given keys and values to L2 and L1.
+func (c *Cache) SetMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/tiered.SetMulti")
+	defer func() { span.End() }()
+
+	items := make([]*cache.Item, len(keys))
+	for i, k := range keys {
+		items[i] = &cache.Item{Key: k, Value: values[i]}
+	}
+	// The errors are reported by SetItems.
+	c.SetItems(ctx, items)
+}
+
+// SetItems saves the given items to L2 and L1. The items are saved to L1 only
+// if they are saved to L2 without an error. The items with leases or Replace
+// are saved only to L2 since L2 may not save them, and the keys of the items
+// with Replace are deleted from L1 so that the values are read from L2.
+func (c *Cache) SetItems(ctx context.Context, items []*cache.Item) error {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/tiered.SetItems")
+	defer func() { span.End() }()
+
+	if err := setItems(ctx, c.l2, c.l2Setter, items); err != nil {
+		c.report(ctx, "L2.SetItems", err)
+		return err
+	}
+
+	var l1Items []*cache.Item
+	var replaced []*datastorepb.Key
+	for _, v := range items {
+		switch {
+		case v.Lease != 0:
+		case v.Replace:
+			replaced = append(replaced, v.Key)
+		default:
+			l1Items = append(l1Items, v)
+		}
+	}
+	if len(replaced) > 0 {
+		if err := c.l1.DeleteMulti(ctx, replaced); err != nil {
+			c.report(ctx, "L1.DeleteMulti", err)
+			return err
+		}
+	}
+	err := c.setL1(ctx, l1Items)
+	c.report(ctx, "L1.SetItems", err)
+	return err
+}
+
+// DeleteMulti deletes the values of the given keys from L2 and L1. L1 is
+// deleted even if L2 returns an error, and the error of L2 is returned.
+func (c *Cache) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/tiered.DeleteMulti")
+	defer func() { span.End() }()
+
+	// L2 is deleted first so that L1 is not filled by the stale value in L2.
+	err := c.l2.DeleteMulti(ctx, keys)
+	c.report(ctx, "L2.DeleteMulti", err)
+	if err1 := c.l1.DeleteMulti(ctx, keys); err1 != nil {
+		c.report(ctx, "L1.DeleteMulti", err1)
+		if err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// setL1 saves the items to L1 with the expiration limited by
+// WithL1Expiration.
+func (c *Cache) setL1(ctx context.Context, items []*cache.Item) error {
+	if c.l1Expiration > 0 {
+		limited := make([]*cache.Item, len(items))
+		for i, v := range items {
+			item := *v
+			if item.Expiration == 0 || item.Expiration > c.l1Expiration {
+				item.Expiration = c.l1Expiration
+			}
+			limited[i] = &item
+		}
+		items = limited
+	}
+	return setItems(ctx, c.l1, c.l1Setter, items)
+}
+
+// setItems saves the items by setter if it is not nil, or by SetMultiWithError
+// of the Cacher.
+func setItems(ctx context.Context, cacher cache.ErrorCacher, setter cache.ItemSetter, items []*cache.Item) error {
+	if len(items) == 0 {
+		return nil
+	}
+	if setter != nil {
+		return setter.SetItems(ctx, items)
+	}
+	keys := make([]*datastorepb.Key, len(items))
+	values := make([][]byte, len(items))
+	for i, v := range items {
+		keys[i] = v.Key
+		values[i] = v.Value
+	}
+	return cacher.SetMultiWithError(ctx, keys, values)
+}
+
+// leaser is a Cache of a cache.Leaser in L2.
+type leaser struct {
+	*Cache
+	leaser cache.Leaser
+}
+
+// LeaseMulti acquires leases for the given keys in L2.
+func (c *leaser) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	return c.leaser.LeaseMulti(ctx, keys)
+}
+
+// locker is a Cache of a cache.Locker in L2.
+type locker struct {
+	*Cache
+	locker cache.Locker
+}
+
+// LeaseMulti acquires leases for the given keys in L2.
+func (c *locker) LeaseMulti(ctx context.Context, keys []*datastorepb.Key) ([]uint64, error) {
+	return c.locker.LeaseMulti(ctx, keys)
+}
+
+// LockMulti locks the given keys in L2, and deletes them from L1 so that the
+// locked keys are missing.
+func (c *locker) LockMulti(ctx context.Context, keys []*datastorepb.Key, expiration time.Duration) error {
+	ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/cache/tiered.LockMulti")
+	defer func() { span.End() }()
+
+	if err := c.locker.LockMulti(ctx, keys, expiration); err != nil {
+		c.report(ctx, "L2.LockMulti", err)
+		return err
+	}
+	err := c.l1.DeleteMulti(ctx, keys)
+	c.report(ctx, "L1.DeleteMulti", err)
+	return err
+}
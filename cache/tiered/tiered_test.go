@@ -0,0 +1,216 @@
+package tiered
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DeNA/cloud-datastore-interceptor/cache"
+	"github.com/DeNA/cloud-datastore-interceptor/cache/memory"
+	"go.opencensus.io/stats/view"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+var errBackend = errors.New("backend error")
+
+// errorCacher is a cache.ErrorCacher that always fails.
+type errorCacher struct{}
+
+func (errorCacher) GetMulti(ctx context.Context, keys []*datastorepb.Key) [][]byte { return nil }
+
+func (errorCacher) SetMulti(ctx context.Context, keys []*datastorepb.Key, values [][]byte) {}
+
+func (errorCacher) GetMultiWithError(ctx context.Context, keys []*datastorepb.Key) ([][]byte, error) {
+	return nil, errBackend
+}
+
+func (errorCacher) SetMultiWithError(ctx context.Context, keys []*datastorepb.Key, values [][]byte) error {
+	return errBackend
+}
+
+func (errorCacher) DeleteMulti(ctx context.Context, keys []*datastorepb.Key) error {
+	return errBackend
+}
+
+// lockCacher is the Cacher returned by NewCache for L2 of a cache.Locker.
+type lockCacher interface {
+	cache.Cacher
+	cache.Locker
+}
+
+var keys = []*datastorepb.Key{
+	{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}},
+	{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 2}}}},
+	{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 3}}}},
+}
+
+func TestCache_GetMulti(t *testing.T) {
+	if err := view.Register(DefaultViews...); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Unregister(DefaultViews...)
+
+	l1 := memory.NewCache(cache.Expiration{})
+	l2 := memory.NewCache(cache.Expiration{})
+	l1.SetMulti(context.Background(), keys[:1], [][]byte{{'a'}})
+	l2.SetMulti(context.Background(), keys[:2], [][]byte{{'x'}, {'b'}})
+
+	c := NewCache(l1, l2)
+	want := [][]byte{{'a'}, {'b'}, nil}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+	if got := l1.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("L1 = %v, want the value found in L2 to be saved", got)
+	}
+
+	rows, err := view.RetrieveData(HitsView.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]int64)
+	for _, r := range rows {
+		for _, tag := range r.Tags {
+			if tag.Key == KeyTier {
+				got[tag.Value] = int64(r.Data.(*view.SumData).Value)
+			}
+		}
+	}
+	if want := map[string]int64{"l1": 1, "l2": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("%s = %v, want %v", HitsView.Name, got, want)
+	}
+}
+
+func TestCache_SetItems(t *testing.T) {
+	l1 := memory.NewCache(cache.TTL(1 * time.Hour))
+	l2 := memory.NewCache(cache.TTL(1 * time.Hour))
+
+	c := NewCache(l1, l2, WithL1Expiration(1*time.Nanosecond)).(lockCacher)
+	if err := c.SetItems(context.Background(), []*cache.Item{
+		{Key: keys[0], Value: []byte{'a'}, Version: 2},
+		{Key: keys[1], Value: []byte{'b'}, Expiration: 1 * time.Hour},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	c.SetMulti(context.Background(), keys[2:], [][]byte{{'c'}})
+	time.Sleep(1 * time.Millisecond)
+
+	want := [][]byte{{'a'}, {'b'}, {'c'}}
+	if got := l2.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("L2 = %v, want %v", got, want)
+	}
+	if got := l1.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil, nil}) {
+		t.Errorf("L1 = %v, want the items to expire by WithL1Expiration", got)
+	}
+}
+
+func TestCache_SetItemsWithLease(t *testing.T) {
+	l1 := memory.NewCache(cache.Expiration{})
+	l2 := memory.NewCache(cache.Expiration{})
+	l1.SetMulti(context.Background(), keys[1:], [][]byte{{'x'}, {'y'}})
+	l2.SetMulti(context.Background(), keys[1:], [][]byte{{'x'}, {'y'}})
+
+	c := NewCache(l1, l2).(lockCacher)
+	leases, err := c.LeaseMulti(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leases[0] == 0 || leases[1] != 0 || leases[2] != 0 {
+		t.Fatalf("Cache.LeaseMulti() = %v, want a lease only for the key missing in L2", leases)
+	}
+	if err := c.SetItems(context.Background(), []*cache.Item{
+		{Key: keys[0], Value: []byte{'a'}, Lease: leases[0]},
+		{Key: keys[1], Value: []byte{'b'}, Replace: true},
+		{Key: keys[2], Value: []byte{'c'}},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]byte{{'a'}, {'b'}, {'c'}}
+	if got := l2.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("L2 = %v, want %v", got, want)
+	}
+	if got := l1.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, [][]byte{nil, nil, {'c'}}) {
+		t.Errorf("L1 = %v, want the items with a lease or Replace not to be saved", got)
+	}
+	if got := c.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+}
+
+func TestCache_LockMulti(t *testing.T) {
+	l1 := memory.NewCache(cache.Expiration{})
+	l2 := memory.NewCache(cache.Expiration{})
+	c := NewCache(l1, l2).(lockCacher)
+	c.SetMulti(context.Background(), keys[:2], [][]byte{{'a'}, {'b'}})
+
+	if err := c.LockMulti(context.Background(), keys[:1], 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{nil, {'b'}}
+	if got := c.GetMulti(context.Background(), keys[:2]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+	if leases, _ := l2.LeaseMulti(context.Background(), keys[:1]); leases[0] != 0 {
+		t.Errorf("L2.LeaseMulti() = %v, want the key to be locked in L2", leases)
+	}
+}
+
+func TestNewCache(t *testing.T) {
+	c := NewCache(memory.NewCache(cache.Expiration{}), struct{ cache.Cacher }{memory.NewCache(cache.Expiration{})})
+	if _, ok := c.(cache.Leaser); ok {
+		t.Error("NewCache() implements cache.Leaser, want not to implement it for L2 of a Cacher")
+	}
+	if _, ok := c.(cache.ItemSetter); !ok {
+		t.Error("NewCache() does not implement cache.ItemSetter")
+	}
+}
+
+func TestCache_DeleteMulti(t *testing.T) {
+	l1 := memory.NewCache(cache.Expiration{})
+	l2 := memory.NewCache(cache.Expiration{})
+	c := NewCache(l1, l2)
+	c.SetMulti(context.Background(), keys, [][]byte{{'a'}, {'b'}, {'c'}})
+
+	if err := c.DeleteMulti(context.Background(), keys[:2]); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]byte{nil, nil, {'c'}}
+	if got := l1.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("L1 = %v, want %v", got, want)
+	}
+	if got := l2.GetMulti(context.Background(), keys); !reflect.DeepEqual(got, want) {
+		t.Errorf("L2 = %v, want %v", got, want)
+	}
+}
+
+func TestCache_L2Error(t *testing.T) {
+	l1 := memory.NewCache(cache.Expiration{})
+	l1.SetMulti(context.Background(), keys[:1], [][]byte{{'a'}})
+
+	var methods []string
+	c := NewCache(l1, errorCacher{}, WithErrorHandler(func(ctx context.Context, method string, err error) {
+		if err != errBackend {
+			t.Errorf("%s error = %v, want %v", method, err, errBackend)
+		}
+		methods = append(methods, method)
+	}))
+
+	if got, want := c.GetMulti(context.Background(), keys[:2]), [][]byte{{'a'}, nil}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Cache.GetMulti() = %v, want %v", got, want)
+	}
+	if err := c.(cache.ItemSetter).SetItems(context.Background(), []*cache.Item{{Key: keys[1], Value: []byte{'b'}}}); err != errBackend {
+		t.Errorf("Cache.SetItems() error = %v, want %v", err, errBackend)
+	}
+	if err := c.DeleteMulti(context.Background(), keys[:1]); err != errBackend {
+		t.Errorf("Cache.DeleteMulti() error = %v, want %v", err, errBackend)
+	}
+	if got := l1.GetMulti(context.Background(), keys[:2]); !reflect.DeepEqual(got, [][]byte{nil, nil}) {
+		t.Errorf("L1 = %v, want L1 to be deleted and not to be saved", got)
+	}
+	if want := []string{"L2.GetMulti", "L2.SetItems", "L2.DeleteMulti"}; !reflect.DeepEqual(methods, want) {
+		t.Errorf("reported methods = %v, want %v", methods, want)
+	}
+}
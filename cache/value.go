@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// tombstone is the first byte of a cached value for a missing entity. It is
+// never the first byte of a marshaled EntityResult because the field number 0
+// is invalid in protocol buffers.
+const tombstone = 0x00
+
+// softExpiring is the first byte of a cached value with the soft expiration
+// set by WithStaleWhileRevalidate. It is followed by the soft expiration and
+// the duration of the retrieval in nanoseconds, and the cached value. Like
+// tombstone, it is never the first byte of a marshaled EntityResult.
+const softExpiring = 0x01
+
+// softExpiringHeaderSize is the size of the header of a value with the soft
+// expiration.
+const softExpiringHeaderSize = 1 + 8 + 8
+
+var errInvalidValue = errors.New("cache: invalid cached value")
+
+// freshness is the soft expiration of a cached value.
+type freshness struct {
+	// expiry is the soft expiration. It is zero if the value has no soft
+	// expiration.
+	expiry time.Time
+
+	// delta is the duration to retrieve the value from the datastore.
+	delta time.Duration
+}
+
+// stale reports whether the value should be refreshed at now. The value is
+// refreshed after the soft expiration, or before it by the probabilistic
+// early expiration (XFetch) if beta is positive: at now such that
+// now - delta * beta * log(rand()) >= expiry.
+func (f freshness) stale(now time.Time, beta float64) bool {
+	if f.expiry.IsZero() {
+		return false
+	}
+	if beta > 0 && f.delta > 0 {
+		// 1 - rand.Float64() is in (0, 1].
+		now = now.Add(time.Duration(-float64(f.delta) * beta * math.Log(1-rand.Float64())))
+	}
+	return !now.Before(f.expiry)
+}
+
+// withFreshness returns the cached value with the soft expiration.
+func withFreshness(b []byte, f freshness) []byte {
+	ret := make([]byte, softExpiringHeaderSize, softExpiringHeaderSize+len(b))
+	ret[0] = softExpiring
+	binary.BigEndian.PutUint64(ret[1:9], uint64(f.expiry.UnixNano()))
+	binary.BigEndian.PutUint64(ret[9:17], uint64(f.delta))
+	return append(ret, b...)
+}
+
+// splitFreshness returns the cached value without the soft expiration and the
+// soft expiration.
+func splitFreshness(b []byte) ([]byte, freshness, error) {
+	if len(b) == 0 || b[0] != softExpiring {
+		return b, freshness{}, nil
+	}
+	if len(b) < softExpiringHeaderSize {
+		return nil, freshness{}, errInvalidValue
+	}
+	return b[softExpiringHeaderSize:], freshness{
+		expiry: time.Unix(0, int64(binary.BigEndian.Uint64(b[1:9]))),
+		delta:  time.Duration(binary.BigEndian.Uint64(b[9:17])),
+	}, nil
+}
+
+// marshalResult returns the cached value of the given EntityResult. If missing
+// is true, the value is a tombstone that represents the entity does not exist.
+func marshalResult(e *datastorepb.EntityResult, missing bool) ([]byte, error) {
+	b, err := proto.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	if missing {
+		b = append([]byte{tombstone}, b...)
+	}
+	return b, nil
+}
+
+// unmarshalResult parses the cached value. It reports whether the value is a
+// tombstone. The soft expiration of the value is ignored.
+func unmarshalResult(b []byte) (*datastorepb.EntityResult, bool, error) {
+	b, _, err := splitFreshness(b)
+	if err != nil {
+		return nil, false, err
+	}
+	missing := len(b) > 0 && b[0] == tombstone
+	if missing {
+		b = b[1:]
+	}
+
+	var e datastorepb.EntityResult
+	if err := proto.Unmarshal(b, &e); err != nil {
+		return nil, false, err
+	}
+	if e.GetEntity().GetKey() == nil {
+		return nil, false, errInvalidValue
+	}
+	return &e, missing, nil
+}
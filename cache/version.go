@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"sync"
+
+	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
+)
+
+// maxCommittedVersions is the maximum number of keys whose versions are
+// recorded by committedVersions.
+const maxCommittedVersions = 10000
+
+// committedVersions records the latest versions of entities committed by this
+// process.
+type committedVersions struct {
+	mu       sync.Mutex
+	versions map[string]int64
+}
+
+func newCommittedVersions() *committedVersions {
+	return &committedVersions{versions: make(map[string]int64)}
+}
+
+// update records the versions of the mutation results.
+func (c *committedVersions) update(in *datastorepb.CommitRequest, out *datastorepb.CommitResponse) {
+	results := out.GetMutationResults()
+	if len(results) != len(in.GetMutations()) {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, v := range in.GetMutations() {
+		var key *datastorepb.Key
+		switch op := v.GetOperation().(type) {
+		case *datastorepb.Mutation_Insert:
+			key = op.Insert.GetKey()
+		case *datastorepb.Mutation_Update:
+			key = op.Update.GetKey()
+		case *datastorepb.Mutation_Upsert:
+			key = op.Upsert.GetKey()
+		case *datastorepb.Mutation_Delete:
+			key = op.Delete
+		}
+		if k := results[i].GetKey(); k != nil {
+			key = k
+		}
+		if !isComplete(key) {
+			continue
+		}
+
+		ks := keyString(key)
+		if results[i].GetVersion() <= c.versions[ks] {
+			continue
+		}
+		if _, ok := c.versions[ks]; !ok && len(c.versions) >= maxCommittedVersions {
+			// Forget an arbitrary key. It only makes the check loose.
+			for k := range c.versions {
+				delete(c.versions, k)
+				break
+			}
+		}
+		c.versions[ks] = results[i].GetVersion()
+	}
+}
+
+// outdated reports whether the version of the key lags behind the committed
+// version by more than lag.
+func (c *committedVersions) outdated(key *datastorepb.Key, version, lag int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.versions[keyString(key)]
+	return ok && v-version > lag
+}
@@ -3,9 +3,12 @@ module github.com/DeNA/cloud-datastore-interceptor
 require (
 	cloud.google.com/go v0.44.1
 	cloud.google.com/go/datastore v1.0.0
+	github.com/bradfitz/gomemcache v0.0.0-20190913173617-a41fca850d0b
 	github.com/go-redis/redis v6.15.6+incompatible
 	github.com/golang/protobuf v1.3.2
+	github.com/golang/snappy v0.0.4
 	github.com/google/go-cmp v0.3.0
+	github.com/klauspost/compress v1.11.13
 	github.com/onsi/ginkgo v1.10.3 // indirect
 	github.com/onsi/gomega v1.7.1 // indirect
 	go.opencensus.io v0.22.0
@@ -6,7 +6,9 @@ package transform
 import (
 	"context"
 	"errors"
+	"strings"
 
+	"go.opencensus.io/trace"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 	"google.golang.org/grpc"
 )
@@ -18,17 +20,25 @@ func QueryToLookupWithKeysOnly() grpc.UnaryClientInterceptor {
 		if method != "/google.datastore.v1.Datastore/RunQuery" {
 			return invoker(ctx, method, req, reply, cc, opts...)
 		}
+		ctx, span := trace.StartSpan(ctx, "github.com/DeNA/cloud-datastore-interceptor/transform.QueryToLookupWithKeysOnly")
+		defer func() { span.End() }()
+		span.AddAttributes(trace.StringAttribute("method", method))
+
 		in := req.(*datastorepb.RunQueryRequest)
 
 		query := in.GetQuery()
 		if query == nil {
 			// GQL not supported.
+			span.AddAttributes(trace.BoolAttribute("transformed", false), trace.StringAttribute("reason", "gql"))
 			return invoker(ctx, method, req, reply, cc, opts...)
 		}
+		span.AddAttributes(trace.StringAttribute("kinds", kinds(query.GetKind())))
 		if query.GetProjection() != nil {
 			// Projection or KeysOnly query.
+			span.AddAttributes(trace.BoolAttribute("transformed", false), trace.StringAttribute("reason", "projection"))
 			return invoker(ctx, method, req, reply, cc, opts...)
 		}
+		span.AddAttributes(trace.BoolAttribute("transformed", true))
 
 		// Invoke KeysOnly query.
 		query.Projection = []*datastorepb.Projection{{Property: &datastorepb.PropertyReference{Name: "__key__"}}}
@@ -41,6 +51,7 @@ func QueryToLookupWithKeysOnly() grpc.UnaryClientInterceptor {
 		out := reply.(*datastorepb.RunQueryResponse)
 
 		result := out.GetBatch().GetEntityResults()
+		span.AddAttributes(trace.Int64Attribute("keys", int64(len(result))))
 		if len(result) == 0 {
 			// Not found.
 			return nil
@@ -77,3 +88,12 @@ func QueryToLookupWithKeysOnly() grpc.UnaryClientInterceptor {
 		return nil
 	}
 }
+
+// kinds returns the names of the kinds separated by commas.
+func kinds(kinds []*datastorepb.KindExpression) string {
+	names := make([]string, len(kinds))
+	for i, v := range kinds {
+		names[i] = v.GetName()
+	}
+	return strings.Join(names, ",")
+}
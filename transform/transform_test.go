@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"sync"
 	"testing"
 
 	"cloud.google.com/go/datastore"
@@ -13,6 +14,7 @@ import (
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"go.opencensus.io/trace"
 	datastorepb "google.golang.org/genproto/googleapis/datastore/v1"
 	"google.golang.org/grpc"
 )
@@ -189,3 +191,55 @@ func TestQueryToLookupWithKeysOnly(t *testing.T) {
 		})
 	}
 }
+
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func TestQueryToLookupWithKeysOnly_trace(t *testing.T) {
+	r := &spanRecorder{}
+	trace.RegisterExporter(r)
+	defer trace.UnregisterExporter(r)
+
+	stub := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		key := &datastorepb.Key{Path: []*datastorepb.Key_PathElement{{Kind: "k", IdType: &datastorepb.Key_PathElement_Id{Id: 1}}}}
+		switch out := reply.(type) {
+		case *datastorepb.RunQueryResponse:
+			out.Batch = &datastorepb.QueryResultBatch{EntityResults: []*datastorepb.EntityResult{{Entity: &datastorepb.Entity{Key: key}}}}
+		case *datastorepb.LookupResponse:
+			out.Found = []*datastorepb.EntityResult{{Entity: &datastorepb.Entity{Key: key}}}
+		}
+		return nil
+	}
+	req := &datastorepb.RunQueryRequest{
+		QueryType: &datastorepb.RunQueryRequest_Query{Query: &datastorepb.Query{Kind: []*datastorepb.KindExpression{{Name: "k"}}}},
+	}
+	ctx, span := trace.StartSpan(context.Background(), "test", trace.WithSampler(trace.AlwaysSample()))
+	err := QueryToLookupWithKeysOnly()(ctx, "/google.datastore.v1.Datastore/RunQuery", req, &datastorepb.RunQueryResponse{}, nil, stub)
+	span.End()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(r.spans))
+	}
+	want := map[string]interface{}{
+		"method":      "/google.datastore.v1.Datastore/RunQuery",
+		"kinds":       "k",
+		"transformed": true,
+		"keys":        int64(1),
+	}
+	if diff := cmp.Diff(want, r.spans[0].Attributes); diff != "" {
+		t.Errorf("span attributes differ: (-want +got)\n%s", diff)
+	}
+}